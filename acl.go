@@ -0,0 +1,199 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ACL is a concurrency-safe access-control list of onion addresses and
+// ed25519 public keys. Blocked peers are refused by the announce handlers
+// and Announce, and never stored or handed out in peer lists. If anything
+// is allowed explicitly, everything else is refused.
+//
+// Entries are either onion addresses, which match regardless of the port,
+// or base64 encoded ed25519 public keys. An ACL backed by a file holds one
+// entry per line, prefixed by "allow " or "block ", and is written back on
+// every change.
+type ACL struct {
+	mu    sync.RWMutex
+	file  string
+	allow map[string]bool
+	block map[string]bool
+}
+
+// NewACL returns an empty ACL which is only kept in memory.
+func NewACL() *ACL {
+	return &ACL{allow: make(map[string]bool), block: make(map[string]bool)}
+}
+
+// LoadACL returns an ACL backed by the given file, loading any entries
+// already found in it.
+func LoadACL(file string) (*ACL, error) {
+	a := NewACL()
+	a.file = file
+
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return a, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: invalid acl line", file, n)
+		}
+		entry, err := aclEntry(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		switch fields[0] {
+		case "allow":
+			a.allow[entry] = true
+		case "block":
+			a.block[entry] = true
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown acl action %s",
+				file, n, fields[0])
+		}
+	}
+
+	return a, scanner.Err()
+}
+
+// aclEntry validates and normalizes the given onion address or base64
+// public key into an ACL entry.
+func aclEntry(s string) (string, error) {
+	if strings.Contains(s, ".onion") {
+		if i := strings.LastIndex(s, ":"); i >= 0 {
+			s = s[:i]
+		}
+		if err := ValidateOnionAddress(s); err != nil {
+			return "", err
+		}
+		return strings.ToLower(s), nil
+	}
+
+	pk, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(pk) != ed25519.PublicKeySize {
+		return "", fmt.Errorf("invalid acl entry: %s", s)
+	}
+	return s, nil
+}
+
+// Allow explicitly allows the given onion address or base64 public key.
+func (a *ACL) Allow(entry string) error {
+	return a.set(a.allow, entry, true)
+}
+
+// Disallow removes the given entry from the allowed ones.
+func (a *ACL) Disallow(entry string) error {
+	return a.set(a.allow, entry, false)
+}
+
+// Block blocks the given onion address or base64 public key.
+func (a *ACL) Block(entry string) error {
+	return a.set(a.block, entry, true)
+}
+
+// Unblock removes the given entry from the blocked ones.
+func (a *ACL) Unblock(entry string) error {
+	return a.set(a.block, entry, false)
+}
+
+func (a *ACL) set(m map[string]bool, entry string, add bool) error {
+	e, err := aclEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if add {
+		m[e] = true
+	} else {
+		delete(m, e)
+	}
+	return a.save()
+}
+
+// Permitted reports whether the given onionaddress:port, and the given
+// public key if it is known, pass the ACL.
+func (a *ACL) Permitted(onion string, pk ed25519.PublicKey) bool {
+	host := onion
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	host = strings.ToLower(host)
+
+	var key string
+	if pk != nil {
+		key = base64.StdEncoding.EncodeToString(pk)
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.block[host] || (key != "" && a.block[key]) {
+		return false
+	}
+	if len(a.allow) > 0 {
+		return a.allow[host] || (key != "" && a.allow[key])
+	}
+	return true
+}
+
+// save writes the ACL to its file, if it has one. The caller must hold
+// a.mu.
+func (a *ACL) save() error {
+	if a.file == "" {
+		return nil
+	}
+
+	var lines []string
+	for e := range a.allow {
+		lines = append(lines, "allow "+e)
+	}
+	for e := range a.block {
+		lines = append(lines, "block "+e)
+	}
+	sort.Strings(lines)
+
+	var buf bytes.Buffer
+	for _, l := range lines {
+		buf.WriteString(l + "\n")
+	}
+	return writeFileAtomic(a.file, buf.Bytes(), 0600)
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	pk, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opk, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64pk := base64.StdEncoding.EncodeToString(pk)
+	onion := testOnion(opk, 666)
+
+	dir, err := ioutil.TempDir("", "tordam-acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "acl")
+
+	a, err := LoadACL(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Permitted(onion, pk) {
+		t.Fatal("empty acl refused a peer")
+	}
+
+	if err := a.Block("foo.onion:1"); err == nil {
+		t.Fatal("invalid onion was blocked")
+	}
+	if err := a.Block("Zm9v"); err == nil {
+		t.Fatal("invalid public key was blocked")
+	}
+
+	// An onion is blocked on every port, and a key under every onion.
+	if err := a.Block(onion); err != nil {
+		t.Fatal(err)
+	}
+	if a.Permitted(testOnion(opk, 1), nil) {
+		t.Fatal("blocked onion permitted on another port")
+	}
+	if err := a.Unblock(onion); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Block(b64pk); err != nil {
+		t.Fatal(err)
+	}
+	if a.Permitted(onion, pk) || !a.Permitted(onion, nil) {
+		t.Fatal("public key block not applied")
+	}
+
+	// Once anything is allowed, everything else is refused, and blocks
+	// still take precedence.
+	if err := a.Allow(onion); err != nil {
+		t.Fatal(err)
+	}
+	if a.Permitted(testOnion(pk, 1), nil) {
+		t.Fatal("peer not on the allowlist was permitted")
+	}
+	if !a.Permitted(onion, nil) || a.Permitted(onion, pk) {
+		t.Fatal("allowlist not applied")
+	}
+
+	b, err := LoadACL(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Permitted(onion, nil) || b.Permitted(onion, pk) ||
+		b.Permitted(testOnion(pk, 1), nil) {
+		t.Fatal("acl was not saved")
+	}
+
+	if err := ioutil.WriteFile(file, []byte("deny "+b64pk+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadACL(file); err == nil {
+		t.Fatal("acl with an unknown action was loaded")
+	}
+}
+
+func TestACLAnnounce(t *testing.T) {
+	n := newTestNode(t)
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opk, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64pk := base64.StdEncoding.EncodeToString(pk)
+	onion := testOnion(pk, 666)
+	other := testOnion(opk, 666)
+
+	// Blocked announcers are refused right away.
+	if err := n.Access.Block(b64pk); err != nil {
+		t.Fatal(err)
+	}
+	vals := []string{onion, b64pk, "12345:54321"}
+	if _, err := n.Ann().Init(context.Background(), vals); err == nil {
+		t.Fatal("blocked public key passed ann.Init")
+	}
+
+	// Blocks applied during the handshake are honored by ann.Validate.
+	if err := n.Access.Unblock(b64pk); err != nil {
+		t.Fatal(err)
+	}
+	ret, err := n.Ann().Init(context.Background(), vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Access.Block(onion); err != nil {
+		t.Fatal(err)
+	}
+	vals = []string{onion, testSign(n, sk, onion, []string{"12345:54321"}, ret)}
+	if _, err := n.Ann().Validate(context.Background(), vals); err == nil {
+		t.Fatal("blocked onion passed ann.Validate")
+	}
+
+	// Blocked peers are neither stored, nor handed out.
+	if err := n.Access.Block(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.AppendPeers([]string{other}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := n.Peers.Get(other); ok {
+		t.Fatal("blocked peer was appended")
+	}
+	if err := n.SetTrust(other, TrustVouched); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Access.Unblock(onion); err != nil {
+		t.Fatal(err)
+	}
+	vals = []string{onion, b64pk, "12345:54321"}
+	ret, err = n.Ann().Init(context.Background(), vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals = []string{onion, testSign(n, sk, onion, []string{"12345:54321"}, ret)}
+	ret, err = n.Ann().Validate(context.Background(), vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range ret {
+		if i == other {
+			t.Fatal("blocked peer was handed out")
+		}
+	}
+
+	if err := n.Announce(context.Background(), other); err == nil ||
+		!strings.Contains(err.Error(), "blocked") {
+		t.Fatalf("announced to a blocked peer (%v)", err)
+	}
+}
@@ -22,7 +22,6 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/base64"
-	"os"
 	"testing"
 )
 
@@ -32,8 +31,7 @@ func TestAnnounce(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	Cfg.Datadir = os.TempDir()
-	LogInit(os.Stdout)
+	n := newTestNode(t)
 
 	vals := []string{
 		"p7qaewjgnvnaeihhyybmoofd5avh665kr3awoxlh5rt6ox743kjdr6qd.onion:666",
@@ -41,11 +39,11 @@ func TestAnnounce(t *testing.T) {
 		"12345:54321,666:3521",
 	}
 
-	ret, err := Ann.Init(Ann{}, context.Background(), vals)
+	ret, err := n.Ann().Init(context.Background(), vals)
 	if err != nil {
 		t.Fatal(err)
 	}
-	for _, i := range ret {
+	for _, i := range ret[:2] {
 		if _, err := base64.StdEncoding.DecodeString(i); err != nil {
 			t.Fatal(err)
 		}
@@ -53,10 +51,10 @@ func TestAnnounce(t *testing.T) {
 
 	vals = []string{
 		"p7qaewjgnvnaeihhyybmoofd5avh665kr3awoxlh5rt6ox743kjdr6qd.onion:666",
-		base64.StdEncoding.EncodeToString(ed25519.Sign(sk, []byte(ret[0]))),
+		testSign(n, sk, vals[0], []string{"12345:54321", "666:3521"}, ret),
 	}
 
-	ret, err = Ann.Validate(Ann{}, context.Background(), vals)
+	ret, err = n.Ann().Validate(context.Background(), vals)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -66,3 +64,100 @@ func TestAnnounce(t *testing.T) {
 		}
 	}
 }
+
+func TestAnnounceBindOnionKey(t *testing.T) {
+	pk, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fpk, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := newTestNode(t)
+	n.Cfg.BindOnionKey = true
+
+	if _, err := n.Ann().Init(context.Background(), []string{
+		testOnion(pk, 666), base64.StdEncoding.EncodeToString(fpk),
+		"12345:54321"}); err == nil {
+		t.Fatal("init with a key foreign to the onion succeeded")
+	}
+
+	if _, err := n.Ann().Init(context.Background(), []string{
+		testOnion(pk, 666), base64.StdEncoding.EncodeToString(pk),
+		"12345:54321"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAnnounceProof(t *testing.T) {
+	responder := newTestNode(t)
+	announcer := newTestNode(t)
+
+	// The responder answers our challenge with a proof of its identity.
+	ret, err := responder.Ann().Init(context.Background(), []string{
+		announcer.Onion, base64.StdEncoding.EncodeToString(testKey(announcer)),
+		"12345:54321", "", "somechallenge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret) != 5 {
+		t.Fatalf("got %d results from a challenged init, expected 5", len(ret))
+	}
+
+	res, err := parseInitResult(ret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ppk, err := announcer.verifyProof(responder.Onion, "somechallenge", res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ppk.Equal(testKey(responder)) {
+		t.Fatal("proof returned the wrong public key")
+	}
+
+	if _, err := announcer.verifyProof(responder.Onion, "otherchallenge", res); err == nil {
+		t.Fatal("proof over a different challenge was accepted")
+	}
+	if _, err := announcer.verifyProof(announcer.Onion, "somechallenge", res); err == nil {
+		t.Fatal("proof for a different responder was accepted")
+	}
+	nores, err := parseInitResult(ret[:3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := announcer.verifyProof(responder.Onion, "somechallenge", nores); err == nil {
+		t.Fatal("missing proof was accepted")
+	}
+
+	// A known peer must prove the key we know.
+	announcer.Peers.Put(responder.Onion, Peer{Pubkey: testKey(announcer)})
+	if _, err := announcer.verifyProof(responder.Onion, "somechallenge", res); err == nil {
+		t.Fatal("proof of a different key than known was accepted")
+	}
+}
+
+func TestAnnouncePinned(t *testing.T) {
+	srv := newTestNode(t)
+	n := newTestNode(t)
+	n.Cfg.TorAddr = startTestServer(t, srv)
+
+	fpk, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.PinSeeds([]Seed{{Onion: srv.Onion, Pubkey: fpk}})
+	if err := n.Announce(context.Background(), srv.Onion); err == nil {
+		t.Fatal("announce to a seed with a mismatching pin succeeded")
+	}
+
+	n.PinSeeds([]Seed{{Onion: srv.Onion, Pubkey: testKey(srv)}})
+	if err := n.Announce(context.Background(), srv.Onion); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(srv.Onion); p.Trusted != TrustPinned {
+		t.Fatalf("pinned seed has trust %d, expected %d", p.Trusted, TrustPinned)
+	}
+}
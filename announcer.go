@@ -0,0 +1,159 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Defaults for Announcer fields left at their zero value.
+const (
+	DefaultAnnounceInterval    = 30 * time.Minute
+	DefaultAnnounceFanout      = 8
+	DefaultAnnounceConcurrency = 4
+	DefaultAnnounceTimeout     = 2 * time.Minute
+)
+
+// Announcer periodically reannounces to a random sample of the known peers,
+// learning new peers from each response, so our view of the network and
+// the network's view of us keep converging. Each round is delayed by a
+// random jitter of up to half the interval, so peers started at the same
+// time don't announce in lockstep.
+type Announcer struct {
+	Node        *Node         // Node announcing, required
+	Interval    time.Duration // Mean time between announce rounds
+	Fanout      int           // Number of peers announced to in a round
+	Concurrency int           // Maximum number of concurrent announces
+	Timeout     time.Duration // Time given to each announce
+
+	announce func(context.Context, string) error // Announce, overridable for tests
+}
+
+func (a *Announcer) interval() time.Duration {
+	if a.Interval > 0 {
+		return a.Interval
+	}
+	return DefaultAnnounceInterval
+}
+
+func (a *Announcer) fanout() int {
+	if a.Fanout > 0 {
+		return a.Fanout
+	}
+	return DefaultAnnounceFanout
+}
+
+func (a *Announcer) concurrency() int {
+	if a.Concurrency > 0 {
+		return a.Concurrency
+	}
+	return DefaultAnnounceConcurrency
+}
+
+func (a *Announcer) timeout() time.Duration {
+	if a.Timeout > 0 {
+		return a.Timeout
+	}
+	return DefaultAnnounceTimeout
+}
+
+// Run announces in rounds every interval, with jitter, until ctx is done.
+func (a *Announcer) Run(ctx context.Context) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for {
+		iv := a.interval()
+		delay := iv/2 + time.Duration(rnd.Int63n(int64(iv)))
+		t := time.NewTimer(delay)
+
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+			succ, total := a.Round(ctx)
+			a.Node.rpcInfo(fmt.Sprintf("reannounced to %d of %d peers", succ, total))
+		}
+	}
+}
+
+// Round announces to a random sample of Fanout known peers, at most
+// Concurrency at a time, each within Timeout, and returns the number of
+// successful announces and the number of peers announced to. Peers which
+// left, or are blocked by the Access list, are never sampled.
+func (a *Announcer) Round(ctx context.Context) (int, int) {
+	announce := a.announce
+	if announce == nil {
+		announce = a.Node.Announce
+	}
+
+	var candidates []string
+	a.Node.Peers.Range(func(onion string, peer Peer) bool {
+		if onion != a.Node.Onion && peer.Left == nil &&
+			a.Node.Access.Permitted(onion, peer.key()) {
+			candidates = append(candidates, onion)
+		}
+		return true
+	})
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	rnd.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > a.fanout() {
+		candidates = candidates[:a.fanout()]
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var succ int
+	sem := make(chan struct{}, a.concurrency())
+
+loop:
+	for _, onion := range candidates {
+		select {
+		case <-ctx.Done():
+			break loop
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(onion string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			actx, cancel := context.WithTimeout(ctx, a.timeout())
+			defer cancel()
+			if err := announce(actx, onion); err != nil {
+				a.Node.rpcWarn(fmt.Sprintf("reannouncing to %s failed (%v)", onion, err))
+				return
+			}
+			mu.Lock()
+			succ++
+			mu.Unlock()
+		}(onion)
+	}
+
+	wg.Wait()
+	return succ, len(candidates)
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAnnouncer(t *testing.T) {
+	n := newTestNode(t)
+
+	var onions []string
+	for i := 0; i <= 20; i++ {
+		pk, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		onions = append(onions, testOnion(pk, 666))
+	}
+	blocked := onions[20]
+	onions = onions[:20]
+	if err := n.AppendPeers(onions); err != nil {
+		t.Fatal(err)
+	}
+	n.Peers.Put(blocked, Peer{})
+	if err := n.Access.Block(blocked); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var running, maxRunning int32
+	seen := map[string]int{}
+	a := &Announcer{
+		Node:        n,
+		Fanout:      10,
+		Concurrency: 3,
+		Timeout:     time.Minute,
+		announce: func(ctx context.Context, onion string) error {
+			if d, ok := ctx.Deadline(); !ok || time.Until(d) > time.Minute {
+				t.Error("announce not limited by the timeout")
+			}
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			mu.Lock()
+			seen[onion]++
+			if n > maxRunning {
+				maxRunning = n
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			if onion == onions[0] {
+				return errors.New("unreachable")
+			}
+			return nil
+		},
+	}
+
+	succ, total := a.Round(context.Background())
+	if total != 10 || len(seen) != 10 {
+		t.Fatalf("announced to %d (%d unique) peers, expected 10", total, len(seen))
+	}
+	if seen[blocked] > 0 {
+		t.Fatal("announced to a blocked peer")
+	}
+	if maxRunning > 3 {
+		t.Fatalf("%d concurrent announces, expected at most 3", maxRunning)
+	}
+	if _, failed := seen[onions[0]]; (failed && succ != 9) || (!failed && succ != 10) {
+		t.Fatalf("got %d successful announces", succ)
+	}
+
+	// Run keeps announcing in rounds until it is stopped.
+	seen = map[string]int{}
+	a.Interval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(done)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	var calls int
+	for _, n := range seen {
+		calls += n
+	}
+	if calls <= 10 {
+		t.Fatalf("%d announces in Run, expected several rounds", calls)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"strconv"
+	"strings"
+)
+
+// announceTag is the protocol tag and version of the announce Challenge.
+// It must be changed whenever the Challenge format changes, so signatures
+// over one format can never be valid in another.
+const announceTag = "tordam-announce-v1"
+
+// Challenge is the structured message an announcing peer signs in order to
+// complete the announce handshake. It binds the signature to the nonce, to
+// both parties and to the announced portmap, so it cannot be replayed in
+// any other context.
+type Challenge struct {
+	Responder string   // onionaddress:port of the peer being announced to
+	Announcer string   // onionaddress:port of the announcing peer
+	Nonce     string   // Nonce handed out by the responder in ann.Init
+	Portmap   []string // Portmap the announcer sent in ann.Init
+	Timestamp int64    // Time the responder handed out the nonce
+}
+
+// Bytes returns the canonical encoding of the challenge, which is what
+// gets signed and verified. None of the fields can contain a newline, as
+// they are all validated beforehand.
+func (c Challenge) Bytes() []byte {
+	return []byte(strings.Join([]string{
+		announceTag,
+		c.Responder,
+		c.Announcer,
+		c.Nonce,
+		strings.Join(c.Portmap, ","),
+		strconv.FormatInt(c.Timestamp, 10),
+	}, "\n"))
+}
+
+// proofTag is the protocol tag and version of the responder's Proof.
+const proofTag = "tordam-proof-v1"
+
+// Proof is the structured message a responder signs in ann.Init to prove
+// its identity to the announcing peer, over a challenge chosen by the
+// announcer.
+type Proof struct {
+	Responder string // onionaddress:port of the peer being announced to
+	Announcer string // onionaddress:port of the announcing peer
+	Challenge string // Random challenge chosen by the announcer
+	Timestamp int64  // Time the responder signed the proof
+}
+
+// Bytes returns the canonical encoding of the proof, which is what gets
+// signed and verified.
+func (p Proof) Bytes() []byte {
+	return []byte(strings.Join([]string{
+		proofTag,
+		p.Responder,
+		p.Announcer,
+		p.Challenge,
+		strconv.FormatInt(p.Timestamp, 10),
+	}, "\n"))
+}
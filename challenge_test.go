@@ -0,0 +1,90 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+)
+
+func TestChallenge(t *testing.T) {
+	n := newTestNode(t)
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+	portmap := []string{"1234:4321"}
+
+	initvals := []string{onion, base64.StdEncoding.EncodeToString(pk), portmap[0]}
+	validate := func(sig string) error {
+		_, err := n.Ann().Validate(context.Background(), []string{onion, sig})
+		return err
+	}
+
+	// A bare nonce signature is only accepted in legacy mode.
+	ret, err := n.Ann().Init(context.Background(), initvals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bare := base64.StdEncoding.EncodeToString(ed25519.Sign(sk, []byte(ret[0])))
+	if err := validate(bare); err == nil {
+		t.Fatal("bare nonce signature was accepted")
+	}
+
+	n.Cfg.LegacyChallenge = true
+	ret, err = n.Ann().Init(context.Background(), initvals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bare = base64.StdEncoding.EncodeToString(ed25519.Sign(sk, []byte(ret[0])))
+	err = validate(bare)
+	n.Cfg.LegacyChallenge = false
+	if err != nil {
+		t.Fatalf("bare nonce signature was refused in legacy mode: %v", err)
+	}
+
+	// A challenge meant for a different responder must be refused.
+	initvals = append(initvals, ret[1])
+	ret, err = n.Ann().Init(context.Background(), initvals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chal := Challenge{
+		Responder: testOnion(pk, 1),
+		Announcer: onion,
+		Nonce:     ret[0],
+		Portmap:   portmap,
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(sk, chal.Bytes()))
+	if err := validate(sig); err == nil {
+		t.Fatal("challenge for a different responder was accepted")
+	}
+
+	ret, err = n.Ann().Init(context.Background(), initvals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validate(testSign(n, sk, onion, portmap, ret)); err != nil {
+		t.Fatal(err)
+	}
+}
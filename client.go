@@ -0,0 +1,189 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/channel"
+	"golang.org/x/net/proxy"
+)
+
+// Client is a JSON-RPC client of the ann endpoint of a peer, with a method
+// for each of its calls. Optional parameters left empty at the end of a
+// call are not sent, as older peers refuse parameters they don't know.
+// Errors sent by the peer have the concrete type *jrpc2.Error.
+type Client struct {
+	cli *jrpc2.Client
+}
+
+// InitResult is the result of an ann.Init call. Fields added by newer
+// versions of the protocol are left empty by older peers.
+type InitResult struct {
+	Nonce      string            // Nonce to be signed in the Challenge
+	Revoke     string            // Revoke key issued to us
+	Timestamp  int64             // Time the nonce was issued
+	Pubkey     ed25519.PublicKey // Peer's key, if we challenged it
+	Signature  []byte            // Peer's signature of the Proof
+	Difficulty int               // Proof of work bits demanded by the peer
+}
+
+// NewClient returns a Client speaking to a peer over conn. Closing the
+// client closes conn.
+func NewClient(conn net.Conn) *Client {
+	return &Client{cli: jrpc2.NewClient(channel.RawJSON(conn, conn), nil)}
+}
+
+// DialClient connects to addr with the given dialer, giving up once ctx is
+// done, and returns a Client speaking to the peer there.
+func DialClient(ctx context.Context, d proxy.ContextDialer, addr string) (*Client, error) {
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// Dial connects to the given onion address through the node's Tor SOCKS5
+// proxy, giving up once ctx is done, and returns a Client speaking to it.
+func (n *Node) Dial(ctx context.Context, onionaddr string) (*Client, error) {
+	socks, err := proxy.SOCKS5("tcp", n.Cfg.TorAddr.String(), nil, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	return DialClient(ctx, socks.(proxy.ContextDialer), onionaddr)
+}
+
+// Close closes the connection to the peer.
+func (c *Client) Close() error {
+	return c.cli.Close()
+}
+
+// call calls the given ann method with params, leaving out the empty ones
+// at the end past the first required ones.
+func (c *Client) call(ctx context.Context, method string, required int, params []string, result interface{}) error {
+	for len(params) > required && params[len(params)-1] == "" {
+		params = params[:len(params)-1]
+	}
+	return c.cli.CallResult(ctx, "ann."+method, params, result)
+}
+
+// Init starts the announce handshake of the given onion and public key,
+// with an optional revoke key, and an optional challenge for the peer to
+// prove its identity with.
+func (c *Client) Init(ctx context.Context, onion string, pubkey ed25519.PublicKey, portmap []string, revoke, challenge string) (InitResult, error) {
+	var resp []string
+	if err := c.call(ctx, "Init", 3, []string{onion,
+		base64.StdEncoding.EncodeToString(pubkey), strings.Join(portmap, ","),
+		revoke, challenge}, &resp); err != nil {
+		return InitResult{}, err
+	}
+	return parseInitResult(resp)
+}
+
+// Validate completes the announce handshake of the given onion with the
+// signature of the Challenge, optionally with our record and a proof of
+// work, and returns the peers the peer shares with us.
+func (c *Client) Validate(ctx context.Context, onion string, sig []byte, rec *PeerRecord, pow string) ([]string, error) {
+	var r string
+	if rec != nil {
+		r = rec.String()
+	}
+	var peers []string
+	err := c.call(ctx, "Validate", 2, []string{onion,
+		base64.StdEncoding.EncodeToString(sig), r, pow}, &peers)
+	return peers, err
+}
+
+// Recover asks for a challenge to be signed with the given public key, for
+// the given onion to reclaim its revoke key.
+func (c *Client) Recover(ctx context.Context, onion string, pubkey ed25519.PublicKey) (string, error) {
+	var challenge [1]string
+	err := c.call(ctx, "Recover", 2, []string{onion,
+		base64.StdEncoding.EncodeToString(pubkey)}, &challenge)
+	return challenge[0], err
+}
+
+// Reclaim answers the challenge obtained with Recover with its signature,
+// and returns the new revoke key of the given onion.
+func (c *Client) Reclaim(ctx context.Context, onion string, sig []byte) (string, error) {
+	var revoke [1]string
+	err := c.call(ctx, "Reclaim", 2, []string{onion,
+		base64.StdEncoding.EncodeToString(sig)}, &revoke)
+	return revoke[0], err
+}
+
+// Sync returns a page of the peers changed since the given cursor, which
+// is empty for all of them.
+func (c *Client) Sync(ctx context.Context, onion, revoke, cursor string) (SyncResult, error) {
+	var res SyncResult
+	err := c.call(ctx, "Sync", 3, []string{onion, revoke, cursor}, &res)
+	return res, err
+}
+
+// Leave tells the peer the given onion left the network for good, with
+// the signed Tombstone to be spread.
+func (c *Client) Leave(ctx context.Context, onion, revoke string, tomb Tombstone) error {
+	var ret []string
+	return c.call(ctx, "Leave", 3, []string{onion, revoke, tomb.String()}, &ret)
+}
+
+// Rotate pushes the given Rotation of a key to the peer.
+func (c *Client) Rotate(ctx context.Context, r Rotation) error {
+	var ret []string
+	return c.call(ctx, "Rotate", 2, []string{r.Onion, r.String()}, &ret)
+}
+
+// parseInitResult parses the result of an ann.Init call.
+func parseInitResult(resp []string) (InitResult, error) {
+	var res InitResult
+	if len(resp) < 2 {
+		return res, errors.New("invalid ann.Init response")
+	}
+	res.Nonce, res.Revoke = resp[0], resp[1]
+
+	var err error
+	if len(resp) >= 3 {
+		if res.Timestamp, err = strconv.ParseInt(resp[2], 10, 64); err != nil {
+			return res, errors.New("invalid ann.Init timestamp")
+		}
+	}
+	if len(resp) >= 5 && resp[3] != "" {
+		pk, err := base64.StdEncoding.DecodeString(resp[3])
+		if err != nil || len(pk) != ed25519.PublicKeySize {
+			return res, errors.New("invalid ann.Init public key")
+		}
+		res.Pubkey = pk
+		if res.Signature, err = base64.StdEncoding.DecodeString(resp[4]); err != nil {
+			return res, errors.New("invalid ann.Init signature")
+		}
+	}
+	if len(resp) >= 6 {
+		if res.Difficulty, err = strconv.Atoi(resp[5]); err != nil {
+			return res, errors.New("invalid ann.Init difficulty")
+		}
+	}
+	return res, nil
+}
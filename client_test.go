@@ -0,0 +1,125 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	srv := newTestNode(t)
+	srv.Cfg.Listen = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	s, err := NewServer(srv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(context.Background())
+	defer s.Shutdown(context.Background())
+
+	n := newTestNode(t)
+	ctx := context.Background()
+	cli, err := DialClient(ctx, &net.Dialer{}, s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// Without a challenge, the peer doesn't prove itself.
+	res, err := cli.Init(ctx, n.Onion, testKey(n), n.Cfg.Portmap, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Nonce == "" || res.Revoke == "" || res.Timestamp == 0 || res.Pubkey != nil {
+		t.Fatalf("got %+v for an unchallenged init", res)
+	}
+
+	res, err = cli.Init(ctx, n.Onion, testKey(n), n.Cfg.Portmap, "", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.verifyProof(srv.Onion, "foo", res); err != nil {
+		t.Fatal(err)
+	}
+
+	sig := ed25519.Sign(n.SignKey, Challenge{
+		Responder: srv.Onion,
+		Announcer: n.Onion,
+		Nonce:     res.Nonce,
+		Portmap:   n.Cfg.Portmap,
+		Timestamp: res.Timestamp,
+	}.Bytes())
+	rec := NewRecord(n.SignKey, n.Onion, n.Cfg.Portmap)
+	if _, err := cli.Validate(ctx, n.Onion, sig, &rec, ""); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := srv.Peers.Get(n.Onion); p.Record == nil {
+		t.Fatal("record sent with Validate was not stored")
+	}
+
+	sres, err := cli.Sync(ctx, n.Onion, res.Revoke, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sres.Cursor == "" {
+		t.Fatal("sync returned no cursor")
+	}
+
+	challenge, err := cli.Recover(ctx, n.Onion, testKey(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoke, err := cli.Reclaim(ctx, n.Onion,
+		ed25519.Sign(n.SignKey, recoverMessage(n.Onion, challenge)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoke == "" || revoke == res.Revoke {
+		t.Fatal("reclaim did not issue a new revoke key")
+	}
+
+	if err := cli.Leave(ctx, n.Onion, revoke, NewTombstone(n.SignKey, n.Onion)); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := srv.Peers.Get(n.Onion); p.Left == nil {
+		t.Fatal("peer did not leave")
+	}
+}
+
+func TestParseInitResult(t *testing.T) {
+	for _, i := range [][]string{
+		{"nonce"},
+		{"nonce", "revoke", "foo"},
+		{"nonce", "revoke", "1", "foo", "sig"},
+		{"nonce", "revoke", "1", "", "", "foo"},
+	} {
+		if _, err := parseInitResult(i); err == nil {
+			t.Fatalf("invalid result parsed: %v", i)
+		}
+	}
+
+	res, err := parseInitResult([]string{"nonce", "revoke", "1", "", "", "8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Pubkey != nil || res.Difficulty != 8 {
+		t.Fatalf("got %+v", res)
+	}
+}
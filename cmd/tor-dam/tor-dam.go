@@ -29,15 +29,14 @@ import (
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/creachadair/jrpc2"
-	"github.com/creachadair/jrpc2/channel"
-	"github.com/creachadair/jrpc2/handler"
-	"github.com/creachadair/jrpc2/server"
 	"github.com/parazyd/tordam"
 )
 
@@ -49,8 +48,33 @@ var (
 	datadir = flag.String("d", os.Getenv("HOME")+"/.dam", "Data directory")
 	seeds   = flag.String("s",
 		"p7qaewjgnvnaeihhyybmoofd5avh665kr3awoxlh5rt6ox743kjdr6qd.onion:49371",
-		"List of initial peers (comma-separated)")
+		"List of initial peers (comma-separated, onion:port[@pubkey])")
 	noannounce = flag.Bool("n", false, "Do not announce to peers")
+	revokes    = flag.Bool("r", false, "List stored revocation keys and exit")
+	bindkey    = flag.Bool("k", false,
+		"Use signing key as onion key, and require the same from peers")
+	legacy = flag.Bool("c", false,
+		"Sign and accept bare nonces, for compatibility with older peers")
+	prune = flag.String("p", "",
+		"Prune revocation keys of peers (comma-separated, or \"all\") and exit")
+	reannounce = flag.Duration("i", tordam.DefaultAnnounceInterval,
+		"Interval of reannouncing to known peers (0 to exit after seeding)")
+	fanout = flag.Int("f", tordam.DefaultAnnounceFanout,
+		"Number of peers reannounced to in each interval")
+	timeout = flag.Duration("t", tordam.DefaultAnnounceTimeout,
+		"Time given to each announce, leave or rotation before giving up")
+	share = flag.String("o", "all",
+		"Peers shared with others (all, none, random:N, freshest:N, trust:N)")
+	pow = flag.Int("w", 0,
+		"Proof of work bits demanded from announcing peers")
+	powload = flag.Int("W", 0,
+		"Proof of work bits demanded when too many announces are pending")
+	rotate = flag.Bool("R", false,
+		"Rotate the signing key, push it to all known peers, and exit")
+	leave = flag.Bool("x", false,
+		"Leave the network, telling all known peers to forget us, and exit")
+	block = flag.String("b", "",
+		"Block onions or public keys (comma-separated), saved to the datadir")
 )
 
 // generateED25519Keypair is a helper function to generate it, and save the
@@ -60,6 +84,12 @@ func generateED25519Keypair(dir string) error {
 	if err != nil {
 		return err
 	}
+	return writeED25519Seed(dir, sk)
+}
+
+// writeED25519Seed is a helper function to save the seed of the given key
+// to the seed file in dir.
+func writeED25519Seed(dir string, sk ed25519.PrivateKey) error {
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return err
 	}
@@ -70,6 +100,98 @@ func generateED25519Keypair(dir string) error {
 		[]byte(base64.StdEncoding.EncodeToString(sk.Seed())), 0600)
 }
 
+// rotateED25519Keypair is a helper function to replace our signing key with
+// a new one, keeping the old seed next to it, and to push the rotation to
+// all the peers we know. The rotation is kept in the datadir until all the
+// peers accepted it, and pushed again instead of rotating anew as long as
+// it is there. It refuses to overwrite the old seed of a previous rotation.
+// It returns the number of peers that accepted the rotation.
+func rotateED25519Keypair(ctx context.Context, node *tordam.Node, dir string) (int32, error) {
+	seedpath := filepath.Join(dir, "ed25519.seed")
+	rotpath := filepath.Join(dir, "ed25519.rotation")
+
+	rot, err := loadRotation(rotpath)
+	switch {
+	case err == nil:
+		if rot.Onion != node.Onion ||
+			!rot.NewKey.Equal(node.SignKey.Public().(ed25519.PublicKey)) {
+			return 0, fmt.Errorf("%s doesn't rotate to our signing key", rotpath)
+		}
+		log.Println("Pushing the key rotation kept in", rotpath, "again")
+	case !os.IsNotExist(err):
+		return 0, err
+	default:
+		if _, err := os.Stat(seedpath + ".old"); err == nil {
+			return 0, fmt.Errorf("%s exists, move it away to rotate again",
+				seedpath+".old")
+		} else if !os.IsNotExist(err) {
+			return 0, err
+		}
+
+		_, newsk, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return 0, err
+		}
+		rot = tordam.NewRotation(node.SignKey, newsk, node.Onion)
+
+		// The rotation is kept before the old seed is replaced, so it can
+		// always be pushed again.
+		log.Println("Writing key rotation to", rotpath)
+		if err := ioutil.WriteFile(rotpath, []byte(rot.String()), 0600); err != nil {
+			return 0, err
+		}
+		if err := os.Rename(seedpath, seedpath+".old"); err != nil {
+			return 0, err
+		}
+		log.Println("Kept the old ed25519 key seed in", seedpath+".old")
+		if err := writeED25519Seed(dir, newsk); err != nil {
+			return 0, err
+		}
+		node.SignKey = newsk
+	}
+
+	var wg sync.WaitGroup
+	var succ, total int32
+	for onion, peer := range node.Peers.Snapshot() {
+		if peer.Left != nil || peer.Pubkey == nil {
+			continue
+		}
+		total++
+		wg.Add(1)
+		go func(x string) {
+			rctx, cancel := context.WithTimeout(ctx, *timeout)
+			defer cancel()
+			if err := node.Rotate(rctx, x, rot); err != nil {
+				log.Println("error in rotate:", err)
+			} else {
+				atomic.AddInt32(&succ, 1)
+			}
+			wg.Done()
+		}(onion)
+	}
+	wg.Wait()
+
+	if succ < total {
+		log.Printf("Run with -R again to push the key rotation to the other %d peers.",
+			total-succ)
+		return succ, nil
+	}
+	if err := os.Remove(rotpath); err != nil {
+		return succ, err
+	}
+	return succ, nil
+}
+
+// loadRotation is a helper function to read a key rotation kept in the
+// given file.
+func loadRotation(file string) (tordam.Rotation, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return tordam.Rotation{}, err
+	}
+	return tordam.ParseRotation(string(data))
+}
+
 // loadED25519Seed is a helper function to read an existing key seed and
 // return an ed25519.PrivateKey.
 func loadED25519Seed(file string) (ed25519.PrivateKey, error) {
@@ -86,6 +208,46 @@ func loadED25519Seed(file string) (ed25519.PrivateKey, error) {
 	return ed25519.NewKeyFromSeed(dec), nil
 }
 
+// pruneRevokes removes the revocation keys of the given comma-separated
+// peers (or all of them) from the keyring and the peer database.
+func pruneRevokes(node *tordam.Node, peers, peerdb string) error {
+	var onions []string
+	if peers == "all" {
+		for onion := range node.Revokes.Snapshot() {
+			onions = append(onions, onion)
+		}
+	} else {
+		onions = strings.Split(peers, ",")
+	}
+
+	for _, onion := range onions {
+		if err := node.Revokes.Delete(onion); err != nil {
+			return err
+		}
+		node.Peers.Update(onion, func(p tordam.Peer, ok bool) (tordam.Peer, bool) {
+			p.SelfRevoke = ""
+			p.PeerRevoke = ""
+			return p, ok
+		})
+		log.Println("Pruned revocation keys for", onion)
+	}
+
+	return node.SavePeers(peerdb)
+}
+
+// shutdown stops the JSON-RPC server, giving the requests in flight some
+// time to be handled, and waits for Serve to return.
+func shutdown(srv *tordam.Server, srvDone chan error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("error shutting down the JSON-RPC server:", err)
+	}
+	if err := <-srvDone; err != nil {
+		log.Println(err)
+	}
+}
+
 // main here is the reference workflow of tor-dam's peer discovery. Its steps
 // are commented and implement a generic way of using the tordam library.
 func main() {
@@ -93,42 +255,121 @@ func main() {
 	var wg sync.WaitGroup
 	var err error
 
-	// Initialize tordam logger
-	tordam.LogInit(os.Stdout)
+	// Create our tordam node, logging to stdout
+	node := tordam.NewNode(tordam.Config{})
+	node.Log = tordam.NewLogger(os.Stdout)
+
+	// Assign the tordam data directory
+	node.Cfg.Datadir = *datadir
+
+	// Allow the announce handshake of older tordam versions
+	node.Cfg.LegacyChallenge = *legacy
+
+	// Limit how much of the network we disclose to announcing peers
+	node.Cfg.SharePolicy, err = tordam.ParseSharePolicy(*share)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Assign the global tordam data directory
-	tordam.Cfg.Datadir = *datadir
+	// Make announcing to us cost some work, more so under load
+	node.Cfg.PowDifficulty = *pow
+	node.Cfg.PowUnderLoad = *powload
 
 	// Generate the ed25519 keypair used for signing and validating
 	if *generate {
-		if err := generateED25519Keypair(tordam.Cfg.Datadir); err != nil {
+		if err := generateED25519Keypair(node.Cfg.Datadir); err != nil {
 			log.Fatal(err)
 		}
 		os.Exit(0)
 	}
 
-	// Assign portmap to tordam Cfg global and validate it
-	tordam.Cfg.Portmap = strings.Split(*portmap, ",")
-	if err := tordam.ValidatePortmap(tordam.Cfg.Portmap); err != nil {
+	// Load the peers we learned about in previous runs
+	peerdb := filepath.Join(node.Cfg.Datadir, "peers.json")
+	if err := node.LoadPeers(peerdb); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Loaded %d peers from %s", node.Peers.Len(), peerdb)
+
+	// Load the revocation keys we were issued and issued to others, so
+	// we can reannounce to peers after a restart
+	node.Revokes, err = tordam.OpenRevokeStore(
+		filepath.Join(node.Cfg.Datadir, "revoke.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Load the onion addresses and public keys we refuse, or exclusively
+	// accept
+	node.Access, err = tordam.LoadACL(
+		filepath.Join(node.Cfg.Datadir, "acl"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, i := range strings.Split(*block, ",") {
+		if i == "" {
+			continue
+		}
+		if err := node.Access.Block(i); err != nil {
+			log.Fatalf("invalid block entry %s (%v)", i, err)
+		}
+	}
+
+	// Inspect or prune the revocation keyring
+	if *revokes {
+		j, _ := json.MarshalIndent(node.Revokes.Snapshot(), "", "  ")
+		fmt.Println(string(j))
+		os.Exit(0)
+	}
+	if *prune != "" {
+		if err := pruneRevokes(node, *prune, peerdb); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	// Keep writing the peers back to the datadir as they change
+	persistCtx, persistStop := context.WithCancel(context.Background())
+	persistDone := make(chan error)
+	go func() {
+		persistDone <- node.PersistPeers(persistCtx, peerdb, 30*time.Second)
+	}()
+
+	// Demote and remove peers we have not seen in a long time
+	go node.RunReaper(context.Background(), 10*time.Minute)
+
+	// Assign portmap to the node config and validate it
+	node.Cfg.Portmap = strings.Split(*portmap, ",")
+	if err := tordam.ValidatePortmap(node.Cfg.Portmap); err != nil {
 		log.Fatal(err)
 	}
 
 	// Validate and assign the local listening address
-	tordam.Cfg.Listen, err = net.ResolveTCPAddr("tcp", *listen)
+	node.Cfg.Listen, err = net.ResolveTCPAddr("tcp", *listen)
 	if err != nil {
 		log.Fatalf("invalid listen address: %s (%v)", *listen, err)
 	}
 
-	// Load the ed25519 signing key into the tordam global
-	tordam.SignKey, err = loadED25519Seed(
-		filepath.Join(tordam.Cfg.Datadir, "ed25519.seed"))
+	// Load the ed25519 signing key into the node
+	node.SignKey, err = loadED25519Seed(
+		filepath.Join(node.Cfg.Datadir, "ed25519.seed"))
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Use the signing key as the Hidden Service key, so our onion address
+	// and our signing key are the same identity, and require the same
+	// from the peers announcing to us
+	if *bindkey {
+		if err := tordam.WriteHSKey(filepath.Join(node.Cfg.Datadir, "hs"),
+			node.SignKey); err != nil {
+			log.Fatal(err)
+		}
+		node.Cfg.BindOnionKey = true
+	}
+
 	// Spawn Tor daemon and let it settle
-	tor, err := tordam.SpawnTor(tordam.Cfg.Listen, tordam.Cfg.Portmap,
-		tordam.Cfg.Datadir)
+	tor, err := node.SpawnTor(node.Cfg.Listen, node.Cfg.Portmap,
+		node.Cfg.Datadir)
 	defer func() {
 		if err := tor.Process.Kill(); err != nil {
 			log.Println(err)
@@ -138,72 +379,136 @@ func main() {
 		log.Fatal(err)
 	}
 	time.Sleep(2 * time.Second)
-	log.Println("Started Tor daemon on", tordam.Cfg.TorAddr.String())
+	log.Println("Started Tor daemon on", node.Cfg.TorAddr.String())
 
 	// Read the onion hostname from the datadir and map it into the
-	// global tordam.Onion variable
+	// node.Onion field
 	onionaddr, err := ioutil.ReadFile(
-		filepath.Join(tordam.Cfg.Datadir, "hs", "hostname"))
+		filepath.Join(node.Cfg.Datadir, "hs", "hostname"))
 	if err != nil {
 		log.Fatal(err)
 	}
 	onionaddr = []byte(strings.TrimSuffix(string(onionaddr), "\n"))
-	tordam.Onion = strings.Join([]string{
-		string(onionaddr), fmt.Sprint(tordam.Cfg.Listen.Port)}, ":")
-	log.Println("Our onion address is:", tordam.Onion)
-
-	// Start the JSON-RPC server with announce endpoints.
-	// This is done in the program rather than internally in the library
-	// because it is more useful and easier to add additional JSON-RPC
-	// endpoints to the same server if necessary.
-	l, err := net.Listen(jrpc2.Network(tordam.Cfg.Listen.String()))
+	node.Onion = strings.Join([]string{
+		string(onionaddr), fmt.Sprint(node.Cfg.Listen.Port)}, ":")
+	log.Println("Our onion address is:", node.Onion)
+
+	// Make sure Tor picked up our signing key as the onion key
+	if *bindkey {
+		opk, err := tordam.OnionPubkey(node.Onion)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !opk.Equal(node.SignKey.Public()) {
+			log.Fatal("Onion address does not match our signing key")
+		}
+	}
+
+	// Run until we are stopped, if we reannounce or don't announce at all
+	ctx, stop := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Replace our signing key, endorsing the new one with the old one
+	if *rotate {
+		if *bindkey {
+			log.Fatal("Can't rotate a signing key used as onion key")
+		}
+		succ, err := rotateED25519Keypair(ctx, node, node.Cfg.Datadir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Pushed the key rotation to %d peers.", succ)
+		persistStop()
+		<-persistDone
+		return
+	}
+
+	// Tell everybody we are gone for good
+	if *leave {
+		for onion, peer := range node.Peers.Snapshot() {
+			if peer.Left != nil {
+				continue
+			}
+			wg.Add(1)
+			go func(x string) {
+				lctx, cancel := context.WithTimeout(ctx, *timeout)
+				defer cancel()
+				if err := node.Leave(lctx, x); err != nil {
+					log.Println("error in leave:", err)
+				}
+				wg.Done()
+			}(onion)
+		}
+		wg.Wait()
+		persistStop()
+		<-persistDone
+		return
+	}
+
+	// Start the JSON-RPC server with announce endpoints. Additional
+	// JSON-RPC services can be passed to tordam.NewServer, to be served
+	// next to them.
+	srv, err := tordam.NewServer(node, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer l.Close()
-	// JSON-RPC endpoints are assigned here
-	var a tordam.Ann
-	assigner := handler.ServiceMap{
-		// "ann" is the JSON-RPC endpoint for peer discovery/announcement
-		"ann": handler.Map{
-			"Init":     handler.New(a.Init),
-			"Validate": handler.New(a.Validate),
-		},
-	}
+	srvDone := make(chan error)
 	go func() {
-		acc := server.NetAccepter(l, channel.RawJSON)
-		if err := server.Loop(context.TODO(), acc, server.Static(assigner), nil); err != nil {
-			log.Println(err)
-		}
+		srvDone <- srv.Serve(context.Background())
 	}()
-	log.Println("Started JSON-RPC server on", tordam.Cfg.Listen.String())
+	log.Println("Started JSON-RPC server on", srv.Addr())
 
 	// If decided to not announce to anyone
 	if *noannounce {
 		// We shall sit here and wait
-		wg.Add(1)
-		wg.Wait()
+		<-ctx.Done()
+		shutdown(srv, srvDone)
+		persistStop()
+		<-persistDone
+		return
 	}
 
-	// Validate given seeds
+	// Validate given seeds, and the ones found in the seeds file of the
+	// datadir
+	var seedlist []tordam.Seed
 	for _, i := range strings.Split(*seeds, ",") {
-		if err := tordam.ValidateOnionInternal(i); err != nil {
+		seed, err := tordam.ParseSeed(i)
+		if err != nil {
 			log.Fatalf("invalid seed %s (%v)", i, err)
 		}
+		seedlist = append(seedlist, seed)
 	}
+	fileseeds, err := tordam.LoadSeeds(
+		filepath.Join(node.Cfg.Datadir, "seeds"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	seedlist = append(seedlist, fileseeds...)
+
+	// Seeds carrying a public key must prove to hold it before we trust
+	// the peers they give us
+	node.PinSeeds(seedlist)
 
 	// Announce to initial seeds
-	var succ int = 0 // Track of successful announces
-	for _, i := range strings.Split(*seeds, ",") {
+	var succ int32 = 0 // Track of successful announces
+	announced := map[string]bool{}
+	for _, i := range seedlist {
+		if announced[i.Onion] {
+			continue
+		}
+		announced[i.Onion] = true
 		wg.Add(1)
 		go func(x string) {
-			if err := tordam.Announce(x); err != nil {
+			actx, cancel := context.WithTimeout(ctx, *timeout)
+			defer cancel()
+			if err := node.Announce(actx, x); err != nil {
 				log.Println("error in announce:", err)
 			} else {
-				succ++
+				atomic.AddInt32(&succ, 1)
 			}
 			wg.Done()
-		}(i)
+		}(i.Onion)
 	}
 	wg.Wait()
 
@@ -213,7 +518,29 @@ func main() {
 		log.Printf("Successfully announced to %d peers.", succ)
 	}
 
-	// Marshal the global Peers map to JSON and print it out.
-	j, _ := json.Marshal(tordam.Peers)
+	// Marshal the node's Peers store to JSON and print it out.
+	j, _ := json.Marshal(node.Peers)
 	fmt.Println(string(j))
+
+	// Keep reannouncing to the peers we know until we are stopped, so we
+	// stay converged with the rest of the network
+	if *reannounce > 0 {
+		announcer := &tordam.Announcer{
+			Node:     node,
+			Interval: *reannounce,
+			Fanout:   *fanout,
+			Timeout:  *timeout,
+		}
+		log.Printf("Reannouncing to %d peers every %s", *fanout, *reannounce)
+		announcer.Run(ctx)
+	}
+
+	// Let the peers still talking to us finish
+	shutdown(srv, srvDone)
+
+	// Write the peer database one final time
+	persistStop()
+	if err := <-persistDone; err != nil {
+		log.Println("error saving peers:", err)
+	}
 }
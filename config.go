@@ -20,25 +20,132 @@ package tordam
 import (
 	"crypto/ed25519"
 	"net"
+	"time"
 )
 
-// Config is the configuration structure, to be filled by library user.
+// Defaults for Config fields left at their zero value.
+const (
+	DefaultPendingTTL    = 2 * time.Minute
+	DefaultMaxPending    = 1024
+	DefaultPeerFreshness = 6 * time.Hour
+	DefaultPeerTTL       = 24 * time.Hour
+	DefaultPeerRemoveTTL = 7 * 24 * time.Hour
+	DefaultSyncLimit     = 256
+	DefaultSyncMaxBytes  = 64 * 1024
+	DefaultRateLimit     = 0.2
+	DefaultRateBurst     = 10
+	DefaultGlobalRate    = 50
+	DefaultGlobalBurst   = 200
+)
+
+// Config is the configuration of a Node, to be filled by library user.
 type Config struct {
-	Listen  *net.TCPAddr // Local listen address for the JSON-RPC server
-	TorAddr *net.TCPAddr // Tor SOCKS5 proxy address, filled by SpawnTor()
-	Datadir string       // Path to data directory
-	Portmap []string     // The peer's portmap, to be mapped in the Tor HS
+	Listen          *net.TCPAddr  // Local listen address for the JSON-RPC server
+	TorAddr         *net.TCPAddr  // Tor SOCKS5 proxy address, filled by SpawnTor()
+	Datadir         string        // Path to data directory
+	Portmap         []string      // The peer's portmap, to be mapped in the Tor HS
+	BindOnionKey    bool          // Require peers to sign with their onion key
+	PendingTTL      time.Duration // Time to complete a handshake (default 2m)
+	MaxPending      int           // Max. pending handshakes (default 1024)
+	LegacyChallenge bool          // Sign and accept bare nonces for older peers
+	PeerFreshness   time.Duration // Max. age of peers we share (default 6h)
+	PeerTTL         time.Duration // Age at which peers are demoted (default 24h)
+	PeerRemoveTTL   time.Duration // Age at which peers are removed (default 7d)
+	ShareTrust      int           // Min. trust of peers we share (default TrustValidated)
+	SyncLimit       int           // Max. peers in an ann.Sync page (default 256)
+	SyncMaxBytes    int           // Max. size of an ann.Sync page (default 64KiB)
+	PowDifficulty   int           // Proof of work bits demanded in ann.Init (default 0)
+	PowUnderLoad    int           // Proof of work bits demanded when MaxPending is reached
+	RateLimit       float64       // Ann calls per second per peer (default 0.2, <0 for none)
+	RateBurst       int           // Ann calls a peer can make at once (default 10)
+	GlobalRateLimit float64       // Ann calls per second of all peers (default 50, <0 for none)
+	GlobalRateBurst int           // Ann calls all peers can make at once (default 200)
+
+	// Pins maps onionaddress:port to the ed25519 public key the peer must
+	// prove to hold when we announce to it. See PinSeeds.
+	Pins map[string]ed25519.PublicKey
+
+	// SharePolicy selects the peers handed out in ann.Validate (default
+	// ShareAll). SharePolicies overrides it for callers of the given trust
+	// levels.
+	SharePolicy   SharePolicy
+	SharePolicies map[int]SharePolicy
+}
+
+func (c Config) pendingTTL() time.Duration {
+	if c.PendingTTL > 0 {
+		return c.PendingTTL
+	}
+	return DefaultPendingTTL
+}
+
+func (c Config) maxPending() int {
+	if c.MaxPending > 0 {
+		return c.MaxPending
+	}
+	return DefaultMaxPending
+}
+
+func (c Config) peerFreshness() time.Duration {
+	if c.PeerFreshness > 0 {
+		return c.PeerFreshness
+	}
+	return DefaultPeerFreshness
 }
 
-// SignKey is an ed25519 private key, to be assigned by library user.
-var SignKey ed25519.PrivateKey
+func (c Config) peerTTL() time.Duration {
+	if c.PeerTTL > 0 {
+		return c.PeerTTL
+	}
+	return DefaultPeerTTL
+}
+
+func (c Config) peerRemoveTTL() time.Duration {
+	if c.PeerRemoveTTL > 0 {
+		return c.PeerRemoveTTL
+	}
+	return DefaultPeerRemoveTTL
+}
+
+func (c Config) shareTrust() int {
+	if c.ShareTrust > 0 {
+		return c.ShareTrust
+	}
+	return TrustValidated
+}
 
-// Onion is the library user's something.onion:port identifier. It can be read
-// from the datadir once Tor is spawned.
-var Onion string
+func (c Config) syncLimit() int {
+	if c.SyncLimit > 0 {
+		return c.SyncLimit
+	}
+	return DefaultSyncLimit
+}
 
-// Cfg is the global config structure, to be filled by library user.
-var Cfg = Config{}
+func (c Config) rateLimit() (float64, int) {
+	rate, burst := c.RateLimit, c.RateBurst
+	if rate == 0 {
+		rate = DefaultRateLimit
+	}
+	if burst <= 0 {
+		burst = DefaultRateBurst
+	}
+	return rate, burst
+}
 
-// Peers is the global map of peers
-var Peers = map[string]Peer{}
+func (c Config) globalRateLimit() (float64, int) {
+	rate, burst := c.GlobalRateLimit, c.GlobalRateBurst
+	if rate == 0 {
+		rate = DefaultGlobalRate
+	}
+	if burst <= 0 {
+		burst = DefaultGlobalBurst
+	}
+	return rate, burst
+}
+
+func (c Config) syncMaxBytes() int {
+	if c.SyncMaxBytes > 0 {
+		return c.SyncMaxBytes
+	}
+	return DefaultSyncMaxBytes
+}
@@ -4,5 +4,6 @@ go 1.16
 
 require (
 	github.com/creachadair/jrpc2 v0.35.1
+	golang.org/x/crypto v0.14.0
 	golang.org/x/net v0.17.0
 )
@@ -18,25 +18,26 @@
 package tordam
 
 import (
+	"io"
 	"log"
-	"os"
 	"path"
 	"runtime"
 )
 
-var (
+// Logger holds the loggers a Node writes its messages to.
+type Logger struct {
 	inte *log.Logger
 	warn *log.Logger
 	info *log.Logger
-)
+}
 
-// LogInit is the initializer for the internal tordam logging functions.
-// It should be called from programs using the library, with something like:
-//  tordam.LogInit(os.Stdout)
-func LogInit(f *os.File) {
-	inte = log.New(f, "INTERNAL ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
-	warn = log.New(f, "WARNING: ", log.Ldate|log.Ltime)
-	info = log.New(f, "INFO: ", log.Ldate|log.Ltime)
+// NewLogger returns a Logger writing to w.
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{
+		inte: log.New(w, "INTERNAL ERROR: ", log.Ldate|log.Ltime|log.Lshortfile),
+		warn: log.New(w, "WARNING: ", log.Ldate|log.Ltime),
+		info: log.New(w, "INFO: ", log.Ldate|log.Ltime),
+	}
 }
 
 func fname() string {
@@ -48,14 +49,14 @@ func fname() string {
 	}
 }
 
-func rpcWarn(msg string) {
-	warn.Printf("%s: %s", fname(), msg)
+func (n *Node) rpcWarn(msg string) {
+	n.Log.warn.Printf("%s: %s", fname(), msg)
 }
 
-func rpcInfo(msg string) {
-	info.Printf("%s: %s", fname(), msg)
+func (n *Node) rpcInfo(msg string) {
+	n.Log.info.Printf("%s: %s", fname(), msg)
 }
 
-func rpcInternalErr(msg string) {
-	inte.Printf("%s: %s", fname(), msg)
+func (n *Node) rpcInternalErr(msg string) {
+	n.Log.inte.Printf("%s: %s", fname(), msg)
 }
@@ -0,0 +1,68 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"crypto/ed25519"
+	"os"
+	"time"
+)
+
+// Node is a tordam peer, holding its identity, its configuration and all
+// it knows about the network. Nodes share no state, so several of them can
+// run in the same process.
+type Node struct {
+	Cfg     Config             // Node configuration
+	SignKey ed25519.PrivateKey // Our ed25519 signing key
+	Onion   string             // Our onionaddress:port
+	Peers   *PeerStore         // Peers we know about
+	Revokes *RevokeStore       // Revocation keys, see OpenRevokeStore
+	Access  *ACL               // Access-control list, see LoadACL
+	Log     *Logger            // Where the node logs to (default os.Stderr)
+
+	pendingAnn     *pendingTable // Handshakes started with ann.Init
+	pendingRecover *pendingTable // Challenges handed out by ann.Recover
+	limiter        *rateLimiter  // Limits the calls to the ann handlers
+}
+
+// NewNode returns a Node with the given configuration, an empty peer
+// store, revocation keyring and ACL, none of which are backed by files.
+// SignKey and Onion must be set before the node announces or serves.
+func NewNode(cfg Config) *Node {
+	n := &Node{
+		Cfg:     cfg,
+		Peers:   NewPeerStore(),
+		Revokes: NewRevokeStore(),
+		Access:  NewACL(),
+		Log:     NewLogger(os.Stderr),
+	}
+	n.pendingAnn = newPendingTable(&n.Cfg)
+	n.pendingRecover = newPendingTable(&n.Cfg)
+	n.limiter = newRateLimiter(&n.Cfg)
+	// ann.Sync only reports the removal of peers it could have shared.
+	n.Peers.shared = func(onion string, peer Peer) bool {
+		return n.shareable(onion, peer, "",
+			time.Now().Add(-n.Cfg.peerFreshness()).Unix())
+	}
+	return n
+}
+
+// Ann returns the JSON-RPC announce endpoint of the node.
+func (n *Node) Ann() Ann {
+	return Ann{n}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"testing"
+)
+
+// TestNodes runs three nodes in the same process, two of them announcing
+// to the third one, and checks that each of them keeps its own view.
+func TestNodes(t *testing.T) {
+	a, b, c := newTestNode(t), newTestNode(t), newTestNode(t)
+	proxy := startTestServer(t, b)
+	a.Cfg.TorAddr = proxy
+	c.Cfg.TorAddr = proxy
+
+	if err := a.Announce(context.Background(), b.Onion); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Announce(context.Background(), b.Onion); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range []string{a.Onion, c.Onion} {
+		if p, ok := b.Peers.Get(i); !ok || p.Trusted != TrustValidated {
+			t.Fatalf("b does not know %s as validated", i)
+		}
+	}
+	if a.Peers.Len() != 1 {
+		t.Fatalf("a knows %d peers, expected only b", a.Peers.Len())
+	}
+	if _, ok := a.Peers.Get(b.Onion); !ok {
+		t.Fatal("a does not know b")
+	}
+	// c learned about a from b.
+	if _, ok := c.Peers.Get(a.Onion); !ok {
+		t.Fatal("c did not learn about a")
+	}
+	if _, ok := c.Revokes.Get(a.Onion); ok {
+		t.Fatal("c got a revocation key for a peer it never announced to")
+	}
+	if k, _ := a.Revokes.Get(b.Onion); k.Self == "" {
+		t.Fatal("a holds no revocation key towards b")
+	}
+	if k, _ := c.Revokes.Get(b.Onion); k.Self == "" {
+		t.Fatal("c holds no revocation key towards b")
+	}
+}
@@ -23,11 +23,28 @@ import (
 
 // Peer is the base struct for any peer in the network.
 type Peer struct {
-	Pubkey     ed25519.PublicKey `json:"pubkey"`     // Peer's ed25519 public key
-	Portmap    []string          `json:"portmap"`    // Peer's port map in Tor
-	Nonce      string            `json:"nonce"`      // The nonce to be signed after announce init
-	SelfRevoke string            `json:"selfrevoke"` // Our revoke key we use to update our data
-	PeerRevoke string            `json:"peerrevoke"` // Peer's revoke key if they wish to update their data
-	LastSeen   int64             `json:"lastseen"`   // Timestamp of last announce
-	Trusted    int               `json:"trusted"`    // Trusted is int because of possible levels of trust
+	Pubkey     ed25519.PublicKey `json:"pubkey"`               // Peer's ed25519 public key
+	Portmap    []string          `json:"portmap"`              // Peer's port map in Tor
+	SelfRevoke string            `json:"selfrevoke"`           // Our revoke key we use to update our data
+	PeerRevoke string            `json:"peerrevoke"`           // Peer's revoke key if they wish to update their data
+	LastSeen   int64             `json:"lastseen"`             // Timestamp of last announce
+	Trusted    int               `json:"trusted"`              // Trust level, one of the Trust* constants
+	Record     *PeerRecord       `json:"record,omitempty"`     // Peer's own signed record, if known
+	SyncCursor string            `json:"synccursor,omitempty"` // Cursor of our last ann.Sync with the peer
+	Left       *Tombstone        `json:"left,omitempty"`       // Peer's tombstone, if it left the network
+	Rotated    int64             `json:"rotated,omitempty"`    // Timestamp of the peer's last key rotation
+}
+
+// key returns the public key of the peer, falling back to the one of its
+// record or tombstone if the peer never proved its key to us directly.
+func (p Peer) key() ed25519.PublicKey {
+	switch {
+	case p.Pubkey != nil:
+		return p.Pubkey
+	case p.Record != nil:
+		return p.Record.Pubkey
+	case p.Left != nil:
+		return p.Left.Pubkey
+	}
+	return nil
 }
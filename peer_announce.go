@@ -20,94 +20,369 @@ package tordam
 import (
 	"context"
 	"crypto/ed25519"
-	"encoding/base64"
+	"errors"
 	"fmt"
-	"strings"
+	"time"
 
 	"github.com/creachadair/jrpc2"
-	"github.com/creachadair/jrpc2/channel"
-	"golang.org/x/net/proxy"
 )
 
-// Announce is a function that announces to a certain onion address. Upon
-// success, it appends the peers received from the endpoint to the global
-// Peers map, which in turn also writes it to the peers db file.
-func Announce(onionaddr string) error {
-	rpcInfo(fmt.Sprintf("Announcing to %s", onionaddr))
+// Announce is a function that announces to a certain onion address, giving
+// up once ctx is done. Upon success, it appends the peers received from the
+// endpoint to the node's Peers store. Failing to reach the peer or to
+// complete the handshake is reported as a *PeerError.
+func (n *Node) Announce(ctx context.Context, onionaddr string) error {
+	n.rpcInfo(fmt.Sprintf("Announcing to %s", onionaddr))
 
 	if err := ValidateOnionInternal(onionaddr); err != nil {
 		return err
 	}
 
-	socks, err := proxy.SOCKS5("tcp", Cfg.TorAddr.String(), nil, proxy.Direct)
+	if known, _ := n.Peers.Get(onionaddr); !n.Access.Permitted(onionaddr, known.key()) {
+		n.rpcWarn(fmt.Sprintf("refusing to announce to blocked %s", onionaddr))
+		return fmt.Errorf("%s is blocked", onionaddr)
+	}
+
+	cli, err := n.Dial(ctx, onionaddr)
+	if err != nil {
+		return peerError(ctx, onionaddr, ErrUnreachable, err)
+	}
+	defer cli.Close()
+
+	if err := n.handshake(ctx, cli, onionaddr); err != nil {
+		return peerError(ctx, onionaddr, ErrRejected, err)
+	}
+	return nil
+}
+
+// handshake announces to the given peer over cli, and verifies the peer's
+// proof of identity in return.
+func (n *Node) handshake(ctx context.Context, cli *Client, onionaddr string) error {
+	pubkey := n.SignKey.Public().(ed25519.PublicKey)
+
+	// We challenge the peer to prove its identity as well.
+	challenge, err := RandomGarbage(32)
 	if err != nil {
 		return err
 	}
 
-	// conn, err := net.Dial(jrpc2.Network(Cfg.Listen), Cfg.Listen)
-	conn, err := socks.Dial("tcp", onionaddr)
+	// If we announced to this peer before, we should have received a revoke
+	// key to use for a subsequent announce.
+	revoke, _ := n.selfRevoke(onionaddr)
+
+	res, err := cli.Init(ctx, n.Onion, pubkey, n.Cfg.Portmap, revoke, challenge)
+	if isRevokeError(err) {
+		// We lost our revoke key, so we prove we still hold the key we
+		// announced with in order to get a new one.
+		n.rpcWarn(fmt.Sprintf("%s refused our revoke key, recovering", onionaddr))
+		if revoke, err = n.recoverRevoke(ctx, cli, onionaddr); err != nil {
+			return err
+		}
+		res, err = cli.Init(ctx, n.Onion, pubkey, n.Cfg.Portmap, revoke, challenge)
+	}
+	if isParamsError(err) && n.Cfg.LegacyChallenge {
+		// Older peers know neither the challenge, nor an empty revoke key.
+		res, err = cli.Init(ctx, n.Onion, pubkey, n.Cfg.Portmap, revoke, "")
+	}
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
 
-	cli := jrpc2.NewClient(channel.RawJSON(conn, conn), nil)
-	defer cli.Close()
-	ctx := context.Background()
+	pk, err := n.verifyProof(onionaddr, challenge, res)
+	if err != nil {
+		return err
+	}
+	if pk != nil && !n.Access.Permitted(onionaddr, pk) {
+		n.rpcWarn(fmt.Sprintf("%s proved a blocked key", onionaddr))
+		return fmt.Errorf("%s is blocked", onionaddr)
+	}
 
-	b64pk := base64.StdEncoding.EncodeToString(
-		SignKey.Public().(ed25519.PublicKey))
+	// Peers not sending a timestamp do not know about the Challenge format,
+	// and expect the bare nonce to be signed.
+	var msg []byte
+	if res.Timestamp != 0 {
+		msg = Challenge{
+			Responder: onionaddr,
+			Announcer: n.Onion,
+			Nonce:     res.Nonce,
+			Portmap:   n.Cfg.Portmap,
+			Timestamp: res.Timestamp,
+		}.Bytes()
+	} else if n.Cfg.LegacyChallenge {
+		msg = []byte(res.Nonce)
+	} else {
+		return fmt.Errorf("%s does not support the challenge format", onionaddr)
+	}
 
-	var resp [2]string
-	data := []string{Onion, b64pk, strings.Join(Cfg.Portmap, ",")}
+	sig := ed25519.Sign(n.SignKey, msg)
 
-	if peer, ok := Peers[onionaddr]; ok {
-		// Here the implication is that it's not our first announce, so we
-		// should have received a revoke key to use for a subsequent announce.
-		data = append(data, peer.SelfRevoke)
+	// We publish our signed record, so the peer can relay it, and receive
+	// the records of the peers it knows in return. Peers not knowing about
+	// records refuse the additional parameter before consuming the nonce.
+	rec := NewRecord(n.SignKey, n.Onion, n.Cfg.Portmap)
+
+	// The peer might demand a proof of work before accepting us.
+	var pow string
+	if res.Difficulty > MaxPowDifficulty {
+		return fmt.Errorf("%s demands too much work (%d bits)",
+			onionaddr, res.Difficulty)
+	} else if res.Difficulty > 0 {
+		pow, err = solvePow(ctx, onionaddr, n.Onion, res.Nonce, res.Difficulty)
+		if err != nil {
+			return err
+		}
 	}
 
-	if err := cli.CallResult(ctx, "ann.Init", data, &resp); err != nil {
+	newPeers, err := cli.Validate(ctx, n.Onion, sig, &rec, pow)
+	if isParamsError(err) {
+		newPeers, err = cli.Validate(ctx, n.Onion, sig, nil, "")
+	}
+	if err != nil {
 		return err
 	}
-	nonce := resp[0]
 
-	// TODO: Think about this >
-	var peer Peer
-	if _, ok := Peers[onionaddr]; ok {
-		peer = Peers[onionaddr]
+	// The revoke key only becomes valid once the handshake is completed.
+	n.setSelfRevoke(onionaddr, res.Revoke)
+
+	// Now that the peer proved its identity, we can remember its key and
+	// trust it accordingly.
+	n.Peers.Update(onionaddr, func(peer Peer, ok bool) (Peer, bool) {
+		if pk != nil {
+			peer.Pubkey = pk
+			// A record relayed with another key than the proven one was
+			// forged.
+			if peer.Record != nil && !peer.Record.Pubkey.Equal(pk) {
+				peer.Record = nil
+			}
+			peer.Trusted = promote(peer.Trusted, TrustValidated)
+			if _, pinned := n.Cfg.Pins[onionaddr]; pinned {
+				peer.Trusted = promote(peer.Trusted, TrustPinned)
+			}
+		}
+		peer.LastSeen = time.Now().Unix()
+		peer.Left = nil
+		return peer, true
+	})
+
+	return n.AppendPeers(newPeers)
+}
+
+// verifyProof verifies the responder's proof of identity found in the given
+// ann.Init result, over the challenge we sent, and returns the proven
+// public key. Proofs are missing from peers not supporting them, which is
+// only accepted with Cfg.LegacyChallenge for peers not in Cfg.Pins, and
+// returns a nil key.
+func (n *Node) verifyProof(onionaddr, challenge string, res InitResult) (ed25519.PublicKey, error) {
+	pin, pinned := n.Cfg.Pins[onionaddr]
+
+	if res.Pubkey == nil {
+		if n.Cfg.LegacyChallenge && !pinned {
+			n.rpcWarn(fmt.Sprintf("%s did not prove its identity", onionaddr))
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s did not prove its identity", onionaddr)
 	}
-	peer.SelfRevoke = resp[1]
-	Peers[onionaddr] = peer
+	pk := res.Pubkey
 
-	sig := base64.StdEncoding.EncodeToString(
-		ed25519.Sign(SignKey, []byte(nonce)))
+	proof := Proof{
+		Responder: onionaddr,
+		Announcer: n.Onion,
+		Challenge: challenge,
+		Timestamp: res.Timestamp,
+	}
+	if !ed25519.Verify(pk, proof.Bytes(), res.Signature) {
+		return nil, fmt.Errorf("%s failed to prove its identity", onionaddr)
+	}
 
-	var newPeers []string
-	if err := cli.CallResult(ctx, "ann.Validate",
-		[]string{Onion, sig}, &newPeers); err != nil {
-		return err
+	if n.Cfg.BindOnionKey {
+		opk, err := OnionPubkey(onionaddr)
+		if err != nil {
+			return nil, err
+		}
+		if !opk.Equal(pk) {
+			return nil, fmt.Errorf("%s proved a key foreign to its onion", onionaddr)
+		}
+	}
+
+	// A pinned peer must prove the pinned key, and any other peer we know
+	// must keep using the same key.
+	if pinned {
+		if !pin.Equal(pk) {
+			return nil, fmt.Errorf("%s proved a key other than pinned", onionaddr)
+		}
+	} else if peer, ok := n.Peers.Get(onionaddr); ok && peer.Pubkey != nil &&
+		!peer.Pubkey.Equal(pk) {
+		return nil, fmt.Errorf("%s proved a different key than known", onionaddr)
+	}
+
+	return pk, nil
+}
+
+// selfRevoke returns the revoke key the given peer issued to us, and
+// whether we ever announced to it. The keyring outlives the peer store, so
+// it is consulted if the peer store doesn't know the key.
+func (n *Node) selfRevoke(onionaddr string) (string, bool) {
+	peer, ok := n.Peers.Get(onionaddr)
+	if peer.SelfRevoke != "" {
+		return peer.SelfRevoke, true
+	}
+	k, _ := n.Revokes.Get(onionaddr)
+	return k.Self, ok || k.Self != ""
+}
+
+// setSelfRevoke stores the revoke key the given peer issued to us.
+func (n *Node) setSelfRevoke(onionaddr, revoke string) {
+	n.Peers.Update(onionaddr, func(peer Peer, ok bool) (Peer, bool) {
+		peer.SelfRevoke = revoke
+		return peer, true
+	})
+	if err := n.Revokes.SetSelf(onionaddr, revoke); err != nil {
+		n.rpcInternalErr(err.Error())
+	}
+}
+
+// isRevokeError reports whether err is a peer refusing our announce
+// because of a missing or mismatching revoke key.
+func isRevokeError(err error) bool {
+	var e *jrpc2.Error
+	if !errors.As(err, &e) {
+		return false
+	}
+	return e.Message == "no revocation key provided" ||
+		e.Message == "revocation key doesn't match"
+}
+
+// isParamsError reports whether err is a peer refusing our call because
+// of the number of parameters, as older peers do for newer calls.
+func isParamsError(err error) bool {
+	var e *jrpc2.Error
+	return errors.As(err, &e) && e.Message == "invalid parameters"
+}
+
+// recoverRevoke obtains a new revoke key from the given peer by signing
+// a recovery challenge with our signing key, and stores it.
+func (n *Node) recoverRevoke(ctx context.Context, cli *Client, onionaddr string) (string, error) {
+	challenge, err := cli.Recover(ctx, n.Onion, n.SignKey.Public().(ed25519.PublicKey))
+	if err != nil {
+		return "", err
+	}
+
+	revoke, err := cli.Reclaim(ctx, n.Onion,
+		ed25519.Sign(n.SignKey, recoverMessage(n.Onion, challenge)))
+	if err != nil {
+		return "", err
 	}
 
-	return AppendPeers(newPeers)
+	n.setSelfRevoke(onionaddr, revoke)
+	n.rpcInfo(fmt.Sprintf("recovered revoke key for %s", onionaddr))
+	return revoke, nil
 }
 
-// AppendPeers appends given []string peers to the global Peers map. Usually
+// AppendPeers appends given []string peers to the node's Peers store. Usually
 // received by validating ourself to a peer and them replying with a list of
-// their valid peers. If a peer is not in format of "unlikelyname.onion:port",
-// they will not be appended.
+// their valid peers. Each peer is either in format of
+// "unlikelyname.onion:port", or a JSON encoded PeerRecord, which is verified
+// and replaces an older record of the same peer, or a Tombstone of a peer
+// which left. Peers which are invalid, or blocked by the Access list, will
+// not be appended.
 // As a placeholder, this function can return an error, but it has no reason
 // to do so right now.
-func AppendPeers(p []string) error {
+func (n *Node) AppendPeers(p []string) error {
+	now := time.Now().Unix()
+
 	for _, i := range p {
-		if _, ok := Peers[i]; ok {
+		var rec *PeerRecord
+		onion := i
+
+		if isTombstone(i) {
+			t, err := n.parseTombstone(i)
+			if err != nil {
+				n.rpcWarn(fmt.Sprintf("received invalid tombstone (%v)", err))
+				continue
+			}
+			if t.Onion != n.Onion && n.Access.Permitted(t.Onion, t.Pubkey) {
+				n.bury(t)
+			}
+			continue
+		}
+
+		if isRecord(i) {
+			r, err := n.parseRecord(i)
+			if err != nil {
+				n.rpcWarn(fmt.Sprintf("received invalid peer record (%v)", err))
+				continue
+			}
+			rec, onion = &r, r.Onion
+		} else if err := ValidateOnionInternal(i); err != nil {
+			n.rpcWarn(fmt.Sprintf("received garbage peer (%v)", err))
 			continue
 		}
-		if err := ValidateOnionInternal(i); err != nil {
-			rpcWarn(fmt.Sprintf("received garbage peer (%v)", err))
+
+		// Our own record gets relayed back to us.
+		if onion == n.Onion {
+			continue
+		}
+
+		known, _ := n.Peers.Get(onion)
+		if !n.Access.Permitted(onion, known.key()) ||
+			(rec != nil && !n.Access.Permitted(onion, rec.Pubkey)) {
+			n.rpcWarn(fmt.Sprintf("received blocked peer %s", onion))
 			continue
 		}
-		Peers[i] = Peer{}
+
+		var conflict bool
+		n.Peers.Update(onion, func(peer Peer, ok bool) (Peer, bool) {
+			// Being told about a peer promotes it, even if it was known.
+			promoted := !ok || peer.Trusted < TrustGossip
+			peer.Trusted = promote(peer.Trusted, TrustGossip)
+			if rec == nil {
+				// LastSeen is when we first heard of the peer, so it
+				// doesn't get reaped right away.
+				if !ok {
+					peer.LastSeen = now
+				}
+				return peer, promoted
+			}
+
+			// A record can't override the key the peer proved to us.
+			if peer.Pubkey != nil && !peer.Pubkey.Equal(rec.Pubkey) {
+				conflict = true
+				return peer, promoted
+			}
+			// Sequence numbers are chosen by the signer, so they only order
+			// the records of the same key. Records of other keys, none of
+			// which was proven, are ordered by their bounded timestamps.
+			if old := peer.Record; old != nil {
+				if old.Pubkey.Equal(rec.Pubkey) && old.Seq >= rec.Seq {
+					return peer, promoted
+				}
+				if !old.Pubkey.Equal(rec.Pubkey) && old.Timestamp >= rec.Timestamp {
+					return peer, promoted
+				}
+			}
+			// Only a record made after the peer left brings it back.
+			if peer.Left != nil {
+				if peer.Left.Timestamp >= rec.Timestamp {
+					return peer, promoted
+				}
+				peer.Left = nil
+			}
+
+			peer.Record = rec
+			peer.Portmap = rec.Portmap
+			// The record vouches for the peer's freshness, but it can't
+			// make the peer seen in the future.
+			if ts := rec.Timestamp; ts > peer.LastSeen {
+				if ts > now {
+					ts = now
+				}
+				peer.LastSeen = ts
+			}
+			return peer, true
+		})
+		if conflict {
+			n.rpcWarn(fmt.Sprintf("received record of %s with a foreign key", onion))
+		}
 	}
 
 	return nil
@@ -0,0 +1,92 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/code"
+)
+
+// Kinds of PeerError, to be tested for with errors.Is.
+var (
+	ErrTimeout     = errors.New("timed out")
+	ErrCanceled    = errors.New("canceled")
+	ErrUnreachable = errors.New("unreachable")
+	ErrRejected    = errors.New("handshake rejected")
+)
+
+// PeerError is the error of talking to a peer, as returned by Announce.
+// errors.Is reports whether it is of a given kind, and errors.As finds the
+// underlying error, e.g. the *jrpc2.Error sent by the peer.
+type PeerError struct {
+	Onion string // Peer we talked to
+	Kind  error  // ErrTimeout, ErrCanceled, ErrUnreachable or ErrRejected
+	Err   error  // Underlying error
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Onion, e.Kind, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *PeerError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the kind of e.
+func (e *PeerError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// peerError returns err as a PeerError of the given kind, unless ctx being
+// done, or err itself, tells it failed for another reason.
+func peerError(ctx context.Context, onionaddr string, kind, err error) error {
+	var ne net.Error
+	var je *jrpc2.Error
+
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		kind = ErrTimeout
+	case errors.Is(ctx.Err(), context.Canceled):
+		kind = ErrCanceled
+	case errors.As(err, &ne) && ne.Timeout():
+		kind = ErrTimeout
+	case errors.As(err, &je):
+		// When the connection breaks, the client fails the calls in
+		// flight with these codes. Errors of the peer's handlers have
+		// other ones.
+		switch je.Code {
+		case code.Cancelled, code.DeadlineExceeded, code.InternalError:
+			kind = ErrUnreachable
+		}
+	case errors.As(err, &ne), errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed),
+		errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		// Context errors not from ctx come from the client giving up on
+		// a broken connection.
+		kind = ErrUnreachable
+	}
+
+	return &PeerError{Onion: onionaddr, Kind: kind, Err: err}
+}
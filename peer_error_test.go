@@ -0,0 +1,123 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/creachadair/jrpc2"
+)
+
+// testListener returns a listener which accepts connections and hands
+// them to f, closed once the test is done.
+func testListener(t *testing.T, f func(net.Conn)) *net.TCPAddr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f(c)
+		}
+	}()
+	return l.Addr().(*net.TCPAddr)
+}
+
+func TestPeerError(t *testing.T) {
+	ctx := context.Background()
+
+	limited := jrpc2.Errorf(CodeRateLimited, "rate limit exceeded").WithData(
+		RateLimitData{RetryAfter: 3})
+	err := peerError(ctx, "foo.onion:1", ErrRejected, limited)
+	if !errors.Is(err, ErrRejected) || errors.Is(err, ErrUnreachable) {
+		t.Fatalf("got %v, expected a rejection", err)
+	}
+	if wait, ok := RetryAfter(err); !ok || wait != 3*time.Second {
+		t.Fatal("rate limit lost by wrapping it")
+	}
+
+	// The context tells why we gave up, whatever the error.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := peerError(cctx, "foo.onion:1", ErrRejected, limited); !errors.Is(err, ErrCanceled) {
+		t.Fatalf("got %v, expected a cancellation", err)
+	}
+}
+
+func TestAnnounceErrors(t *testing.T) {
+	n := newTestNode(t)
+	srv := newTestNode(t)
+
+	// Nothing listens on the proxy port.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Cfg.TorAddr = l.Addr().(*net.TCPAddr)
+	l.Close()
+	if err := n.Announce(context.Background(), srv.Onion); !errors.Is(err, ErrUnreachable) {
+		t.Fatalf("got %v, expected an unreachable peer", err)
+	}
+
+	// The proxy never answers.
+	hang := make(chan struct{})
+	defer close(hang)
+	n.Cfg.TorAddr = testListener(t, func(c net.Conn) {
+		<-hang
+		c.Close()
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := n.Announce(ctx, srv.Onion); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %v, expected a timeout", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := n.Announce(ctx, srv.Onion); !errors.Is(err, ErrCanceled) {
+		t.Fatalf("got %v, expected a cancellation", err)
+	}
+
+	// The peer hangs up in the middle of the handshake.
+	dest := testListener(t, func(c net.Conn) { c.Close() })
+	n.Cfg.TorAddr = testListener(t, func(c net.Conn) {
+		testSocks(c, dest.String())
+	})
+	if err := n.Announce(context.Background(), srv.Onion); !errors.Is(err, ErrUnreachable) {
+		t.Fatalf("got %v, expected an unreachable peer", err)
+	}
+
+	// The peer refuses us.
+	n.Cfg.TorAddr = startTestServer(t, srv)
+	if err := srv.Access.Block(n.Onion); err != nil {
+		t.Fatal(err)
+	}
+	err = n.Announce(context.Background(), srv.Onion)
+	var je *jrpc2.Error
+	if !errors.Is(err, ErrRejected) || !errors.As(err, &je) {
+		t.Fatalf("got %v, expected a rejection by the peer", err)
+	}
+}
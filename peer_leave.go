@@ -0,0 +1,52 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"fmt"
+)
+
+// Leave tells the peer at the given onion address that we left the network
+// for good. It sends our Tombstone, along with the revoke key the peer
+// issued to us, so the peer forgets about us and tells others to do so too.
+// It gives up once ctx is done.
+func (n *Node) Leave(ctx context.Context, onionaddr string) error {
+	n.rpcInfo(fmt.Sprintf("Leaving %s", onionaddr))
+
+	if err := ValidateOnionInternal(onionaddr); err != nil {
+		return err
+	}
+
+	revoke, _ := n.selfRevoke(onionaddr)
+	tomb := NewTombstone(n.SignKey, n.Onion)
+
+	cli, err := n.Dial(ctx, onionaddr)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	if err := cli.Leave(ctx, n.Onion, revoke, tomb); err != nil {
+		return err
+	}
+
+	// The peer forgot the revoke key it issued to us.
+	n.setSelfRevoke(onionaddr, "")
+	return nil
+}
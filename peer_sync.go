@@ -0,0 +1,84 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"fmt"
+)
+
+// SyncPeers fetches the peers added, changed or removed at the given onion
+// address since our last sync with it, page by page, and applies them to the
+// node's Peers store. The sync is authenticated with the revoke key the peer
+// issued to us, so we must have announced to it before. Removed peers are
+// only dropped if we merely heard of them through gossip. It gives up once
+// ctx is done.
+func (n *Node) SyncPeers(ctx context.Context, onionaddr string) error {
+	n.rpcInfo(fmt.Sprintf("Syncing with %s", onionaddr))
+
+	if err := ValidateOnionInternal(onionaddr); err != nil {
+		return err
+	}
+
+	revoke, _ := n.selfRevoke(onionaddr)
+	if revoke == "" {
+		return fmt.Errorf("%s holds no revoke key of ours", onionaddr)
+	}
+
+	peer, _ := n.Peers.Get(onionaddr)
+	if !n.Access.Permitted(onionaddr, peer.key()) {
+		n.rpcWarn(fmt.Sprintf("refusing to sync with blocked %s", onionaddr))
+		return fmt.Errorf("%s is blocked", onionaddr)
+	}
+	cursor := peer.SyncCursor
+
+	cli, err := n.Dial(ctx, onionaddr)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	for {
+		res, err := cli.Sync(ctx, n.Onion, revoke, cursor)
+		if err != nil {
+			return err
+		}
+
+		if err := n.AppendPeers(res.Peers); err != nil {
+			return err
+		}
+
+		removed := make(map[string]bool, len(res.Removed))
+		for _, i := range res.Removed {
+			removed[i] = true
+		}
+		n.Peers.DeleteFunc(func(onion string, p Peer) bool {
+			return removed[onion] && p.Trusted <= TrustGossip
+		})
+
+		cursor = res.Cursor
+		n.Peers.Update(onionaddr, func(p Peer, ok bool) (Peer, bool) {
+			p.SyncCursor = cursor
+			return p, ok
+		})
+
+		if !res.More {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PeerDBVersion is the current version of the on-disk peer database
+// format. It should be bumped whenever the Peer struct changes in a way
+// that needs migrating older databases.
+const PeerDBVersion = 2
+
+// peerDB is the on-disk representation of the peer database.
+type peerDB struct {
+	Version int             `json:"version"`
+	Peers   map[string]Peer `json:"peers"`
+}
+
+// LoadPeers reads the peer database from the given file and stores the
+// found peers in the node's Peers store, skipping any with an invalid
+// onion address or public key. A nonexistent file is not an error, as it
+// simply means we have not saved any peers yet.
+func (n *Node) LoadPeers(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	peers, err := decodePeerDB(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+
+	for onion, peer := range peers {
+		if err := ValidateOnionInternal(onion); err != nil {
+			n.rpcWarn(fmt.Sprintf("skipping garbage peer in db (%v)", err))
+			continue
+		}
+		if peer.Pubkey != nil && len(peer.Pubkey) != ed25519.PublicKeySize {
+			n.rpcWarn(fmt.Sprintf("skipping peer with invalid public key in db (%s)", onion))
+			continue
+		}
+		n.Peers.Put(onion, peer)
+	}
+
+	return nil
+}
+
+// decodePeerDB decodes a peer database of any known version, migrating it
+// to the current format.
+func decodePeerDB(data []byte) (map[string]Peer, error) {
+	var hdr struct {
+		Version *int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &hdr); err != nil {
+		return nil, err
+	}
+
+	// Version 0 is the plain peer map, as marshaled by earlier versions
+	// of the library and tor-dam.
+	if hdr.Version == nil {
+		var peers map[string]Peer
+		if err := json.Unmarshal(data, &peers); err != nil {
+			return nil, err
+		}
+		return migrateTrust(peers), nil
+	}
+
+	var db peerDB
+	switch *hdr.Version {
+	case 1:
+		if err := json.Unmarshal(data, &db); err != nil {
+			return nil, err
+		}
+		return migrateTrust(db.Peers), nil
+	case 2:
+		if err := json.Unmarshal(data, &db); err != nil {
+			return nil, err
+		}
+		return db.Peers, nil
+	}
+
+	return nil, fmt.Errorf("unsupported peer db version %d", *hdr.Version)
+}
+
+// migrateTrust migrates peers from databases before version 2, where
+// Trusted was either 0 or 1 (validated), to the current trust levels.
+func migrateTrust(peers map[string]Peer) map[string]Peer {
+	for onion, peer := range peers {
+		if peer.Trusted > 0 {
+			peer.Trusted = TrustValidated
+		} else if peer.Pubkey == nil {
+			peer.Trusted = TrustGossip
+		}
+		peers[onion] = peer
+	}
+	return peers
+}
+
+// SavePeers atomically writes the node's Peers store to the given file.
+func (n *Node) SavePeers(file string) error {
+	peers, _ := n.Peers.snapshotGen()
+	return savePeers(file, peers)
+}
+
+func savePeers(file string, peers map[string]Peer) error {
+	data, err := json.Marshal(peerDB{Version: PeerDBVersion, Peers: peers})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, data, 0600)
+}
+
+// PersistPeers periodically checks the node's Peers store for changes, and
+// writes it to the given file when it was modified. It blocks until ctx is
+// done, at which point it writes the store one final time.
+func (n *Node) PersistPeers(ctx context.Context, file string, interval time.Duration) error {
+	_, saved := n.Peers.snapshotGen()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			peers, gen := n.Peers.snapshotGen()
+			if gen == saved {
+				return nil
+			}
+			return savePeers(file, peers)
+		case <-t.C:
+			peers, gen := n.Peers.snapshotGen()
+			if gen == saved {
+				continue
+			}
+			if err := savePeers(file, peers); err != nil {
+				n.rpcInternalErr(err.Error())
+				continue
+			}
+			saved = gen
+		}
+	}
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory as
+// file, syncs it to disk, and renames it over file. This way file either
+// contains the old or the new data, but never something in between.
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, filepath.Base(file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), file); err != nil {
+		return err
+	}
+
+	// Sync the directory so the rename itself is durable.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPeerDB(t *testing.T) {
+	n := newTestNode(t)
+	dir, err := ioutil.TempDir("", "tordam-peerdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "peers.json")
+
+	const onion = "p7qaewjgnvnaeihhyybmoofd5avh665kr3awoxlh5rt6ox743kjdr6qd.onion:666"
+
+	n.Peers.Put(onion, Peer{Portmap: []string{"1234:4321"}, Trusted: 1})
+	if err := n.SavePeers(file); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected only the db in %s, found %d files", dir, len(files))
+	}
+
+	n.Peers = NewPeerStore()
+	if err := n.LoadPeers(file); err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := n.Peers.Get(onion); !ok || p.Trusted != 1 || p.Portmap[0] != "1234:4321" {
+		t.Fatalf("loaded peer does not match saved one: %v", p)
+	}
+
+	// A version 0 db is a bare peer map.
+	v0 := []byte(`{"` + onion + `":{"trusted":1}}`)
+	if err := ioutil.WriteFile(file, v0, 0600); err != nil {
+		t.Fatal(err)
+	}
+	n.Peers = NewPeerStore()
+	if err := n.LoadPeers(file); err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := n.Peers.Get(onion); !ok || p.Trusted != TrustValidated {
+		t.Fatalf("version 0 db was not migrated: %v", p)
+	}
+
+	// A peer with a malformed public key would panic on verification.
+	bad := []byte(`{"version":2,"peers":{"` + onion + `":{"pubkey":"AAAA"}}}`)
+	if err := ioutil.WriteFile(file, bad, 0600); err != nil {
+		t.Fatal(err)
+	}
+	n.Peers = NewPeerStore()
+	if err := n.LoadPeers(file); err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := n.Peers.Get(onion); ok {
+		t.Fatalf("peer with malformed public key was loaded: %v", p)
+	}
+
+	if err := ioutil.WriteFile(file, []byte(`{"version":9999}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.LoadPeers(file); err == nil {
+		t.Fatal("unknown db version was accepted")
+	}
+
+	if err := n.LoadPeers(filepath.Join(dir, "nonexistent")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPersistPeers(t *testing.T) {
+	n := newTestNode(t)
+	dir, err := ioutil.TempDir("", "tordam-peerdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "peers.json")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- n.PersistPeers(ctx, file, 10*time.Millisecond) }()
+	time.Sleep(20 * time.Millisecond)
+
+	n.Peers.Put("p7qaewjgnvnaeihhyybmoofd5avh665kr3awoxlh5rt6ox743kjdr6qd.onion:666", Peer{})
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("peer db was not written on change: %v", err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxTombstones is the number of removed entries a PeerStore remembers for
+// Changes. Older removals are forgotten.
+const maxTombstones = 4096
+
+// PeerStore is a concurrency-safe map of peers, keyed by their
+// onionaddress:port identifier. All library code accesses peers through
+// a PeerStore, so it is safe to use from concurrent JSON-RPC handlers
+// and announce goroutines.
+type PeerStore struct {
+	mu      sync.RWMutex
+	peers   map[string]Peer
+	gen     uint64                  // Incremented on every modification
+	epoch   int64                   // Creation time, distinguishing generations
+	mod     map[string]uint64       // Generation each peer was last modified at
+	removed map[string]uint64       // Generation each peer was removed at
+	floor   uint64                  // Generation of the last forgotten removal
+	shared  func(string, Peer) bool // Whether a peer is shared, if tracked
+	spans   map[string]shareSpan    // Generations each peer was last shared over
+}
+
+// shareSpan is the range of generations over which a peer was shared.
+type shareSpan struct {
+	from uint64 // Generation the peer became shared at
+	to   uint64 // Generation it stopped being shared at, 0 if it still is
+}
+
+// NewPeerStore returns an empty, initialized PeerStore.
+func NewPeerStore() *PeerStore {
+	return &PeerStore{
+		peers:   make(map[string]Peer),
+		epoch:   time.Now().UnixNano(),
+		mod:     make(map[string]uint64),
+		removed: make(map[string]uint64),
+		spans:   make(map[string]shareSpan),
+	}
+}
+
+// Change is a modification of a PeerStore entry, as returned by Changes.
+type Change struct {
+	Onion   string // onionaddress:port of the peer
+	Peer    Peer   // The peer, if it wasn't removed
+	Removed bool   // Whether the peer was removed
+	Gen     uint64 // Generation of the modification
+	span    shareSpan
+}
+
+// sharedAt reports whether the peer was shared as of the given generation,
+// as far as the store tracks it.
+func (c Change) sharedAt(gen uint64) bool {
+	return c.span.from != 0 && c.span.from <= gen &&
+		(c.span.to == 0 || c.span.to > gen)
+}
+
+// Get returns the peer stored under the given onion address, and whether
+// it was found.
+func (s *PeerStore) Get(onion string) (Peer, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	peer, ok := s.peers[onion]
+	return peer, ok
+}
+
+// Put stores the given peer under the given onion address, replacing any
+// previous entry.
+func (s *PeerStore) Put(onion string, peer Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(onion, peer)
+}
+
+// Update atomically modifies the peer stored under the given onion address.
+// fn is called with the current entry (the zero Peer if it does not exist)
+// and whether it exists. If fn returns false, the store is left untouched,
+// otherwise the returned peer is stored. fn must not call back into the
+// PeerStore. Update reports whether the entry was written.
+func (s *PeerStore) Update(onion string, fn func(Peer, bool) (Peer, bool)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, ok := s.peers[onion]
+	peer, write := fn(cur, ok)
+	if write {
+		s.put(onion, peer)
+	}
+	return write
+}
+
+// Delete removes the peer stored under the given onion address.
+func (s *PeerStore) Delete(onion string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.peers[onion]; ok {
+		s.delete(onion)
+	}
+}
+
+// DeleteFunc removes every peer for which fn returns true, and returns the
+// number of removed peers. fn must not call back into the PeerStore.
+func (s *PeerStore) DeleteFunc(fn func(string, Peer) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	for onion, peer := range s.peers {
+		if fn(onion, peer) {
+			s.delete(onion)
+			n++
+		}
+	}
+	return n
+}
+
+// put stores a peer and tracks the modification. The caller must hold
+// s.mu.
+func (s *PeerStore) put(onion string, peer Peer) {
+	s.gen++
+	s.peers[onion] = peer
+	s.mod[onion] = s.gen
+	delete(s.removed, onion)
+	s.track(onion, s.shared != nil && s.shared(onion, peer))
+}
+
+// delete removes a peer and leaves a tombstone, forgetting the oldest one
+// if there are too many. The caller must hold s.mu.
+func (s *PeerStore) delete(onion string) {
+	s.gen++
+	delete(s.peers, onion)
+	delete(s.mod, onion)
+	s.removed[onion] = s.gen
+	s.track(onion, false)
+
+	if len(s.removed) > maxTombstones {
+		var oldest string
+		for o, gen := range s.removed {
+			if oldest == "" || gen < s.removed[oldest] {
+				oldest = o
+			}
+		}
+		s.floor = s.removed[oldest]
+		delete(s.removed, oldest)
+		delete(s.spans, oldest)
+	}
+}
+
+// track records whether a peer is shared as of the current generation.
+// The caller must hold s.mu.
+func (s *PeerStore) track(onion string, shared bool) {
+	span, ok := s.spans[onion]
+	switch {
+	case shared && (!ok || span.to != 0):
+		s.spans[onion] = shareSpan{from: s.gen}
+	case !shared && ok && span.to == 0:
+		span.to = s.gen
+		s.spans[onion] = span
+	}
+}
+
+// Len returns the number of peers in the store.
+func (s *PeerStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.peers)
+}
+
+// Range calls fn for every peer in the store, stopping early if fn
+// returns false. Range holds a read lock for its duration, so fn must
+// not call back into the PeerStore.
+func (s *PeerStore) Range(fn func(string, Peer) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for onion, peer := range s.peers {
+		if !fn(onion, peer) {
+			return
+		}
+	}
+}
+
+// Snapshot returns a copy of the peer map which can be freely used without
+// holding any locks.
+func (s *PeerStore) Snapshot() map[string]Peer {
+	ret, _ := s.snapshotGen()
+	return ret
+}
+
+// Generation returns a counter which changes every time the store is
+// modified. It can be used to cheaply detect changes.
+func (s *PeerStore) Generation() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.gen
+}
+
+// Epoch returns the creation time of the store. Generations are only
+// comparable within the same epoch.
+func (s *PeerStore) Epoch() int64 {
+	return s.epoch
+}
+
+// Changes returns the peers modified or removed after the given generation,
+// ordered by the generation of their last modification, along with the
+// current generation and whether the result is complete. If removals since
+// then were already forgotten, it returns every current peer and false
+// instead.
+func (s *PeerStore) Changes(since uint64) ([]Change, uint64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if since < s.floor {
+		return s.modified(0), s.gen, false
+	}
+
+	ret := s.modified(since)
+	for onion, gen := range s.removed {
+		if gen > since {
+			ret = append(ret, Change{Onion: onion, Removed: true, Gen: gen,
+				span: s.spans[onion]})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Gen < ret[j].Gen })
+	return ret, s.gen, true
+}
+
+// Modified returns the current peers modified after the given generation,
+// ordered by the generation of their last modification, along with the
+// current generation. Unlike Changes, it never reports removals, so it can
+// go on with a full view of the peers whatever removals were forgotten.
+func (s *PeerStore) Modified(since uint64) ([]Change, uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.modified(since), s.gen
+}
+
+// modified returns the peers modified after the given generation, ordered
+// by the generation of their last modification. The caller must hold s.mu.
+func (s *PeerStore) modified(since uint64) []Change {
+	var ret []Change
+	for onion, gen := range s.mod {
+		if gen > since {
+			ret = append(ret, Change{Onion: onion, Peer: s.peers[onion], Gen: gen,
+				span: s.spans[onion]})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Gen < ret[j].Gen })
+	return ret
+}
+
+// snapshotGen returns a copy of the peer map along with the generation it
+// was taken at.
+func (s *PeerStore) snapshotGen() (map[string]Peer, uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ret := make(map[string]Peer, len(s.peers))
+	for onion, peer := range s.peers {
+		ret[onion] = peer
+	}
+	return ret, s.gen
+}
+
+// MarshalJSON implements json.Marshaler, encoding the store as a JSON
+// object of onion addresses to peers.
+func (s *PeerStore) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Snapshot())
+}
@@ -0,0 +1,311 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// testOnion returns a v3 onion address with the given port, derived from
+// the given public key.
+func testOnion(pk ed25519.PublicKey, port int) string {
+	return fmt.Sprintf("%s:%d", OnionAddress(pk), port)
+}
+
+// newTestNode returns a Node with a fresh signing key and the matching
+// onion address, logging to stdout.
+func newTestNode(t *testing.T) *Node {
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NewNode(Config{Portmap: []string{"13010:13010"}})
+	n.SignKey = sk
+	n.Onion = testOnion(pk, 49371)
+	n.Log = NewLogger(os.Stdout)
+	return n
+}
+
+// testKey returns the public key of the given node.
+func testKey(n *Node) ed25519.PublicKey {
+	return n.SignKey.Public().(ed25519.PublicKey)
+}
+
+// testSign returns the base64 signature of the Challenge built from the
+// given ann.Init result, announcing onion with portmap to the given node.
+func testSign(n *Node, sk ed25519.PrivateKey, onion string, portmap []string, ret []string) string {
+	ts, _ := strconv.ParseInt(ret[2], 10, 64)
+	chal := Challenge{
+		Responder: n.Onion,
+		Announcer: onion,
+		Nonce:     ret[0],
+		Portmap:   portmap,
+		Timestamp: ts,
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(sk, chal.Bytes()))
+}
+
+// startTestServer starts a Server for the given node on a free local port,
+// and a minimal SOCKS5 proxy which connects every request to it,
+// regardless of the requested destination. It returns the address of the
+// proxy, to be used as Cfg.TorAddr of the announcing nodes.
+func startTestServer(t *testing.T, n *Node) *net.TCPAddr {
+	n.Cfg.Listen = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	srv, err := NewServer(n, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(context.Background())
+
+	sl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := sl.Accept()
+			if err != nil {
+				return
+			}
+			go testSocks(c, srv.Addr().String())
+		}
+	}()
+
+	t.Cleanup(func() {
+		srv.Shutdown(context.Background())
+		sl.Close()
+	})
+
+	return sl.Addr().(*net.TCPAddr)
+}
+
+// testSocks speaks just enough SOCKS5 to accept a CONNECT request, and
+// then pipes the connection to dest.
+func testSocks(c net.Conn, dest string) {
+	defer c.Close()
+
+	buf := make([]byte, 262)
+	// Greeting: version, nmethods, methods
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+		return
+	}
+	if _, err := c.Write([]byte{5, 0}); err != nil {
+		return
+	}
+
+	// Request: version, cmd, rsv, atyp, addr, port
+	if _, err := io.ReadFull(c, buf[:4]); err != nil {
+		return
+	}
+	var alen int
+	switch buf[3] {
+	case 1:
+		alen = 4
+	case 4:
+		alen = 16
+	case 3:
+		if _, err := io.ReadFull(c, buf[:1]); err != nil {
+			return
+		}
+		alen = int(buf[0])
+	default:
+		return
+	}
+	if _, err := io.ReadFull(c, buf[:alen+2]); err != nil {
+		return
+	}
+
+	d, err := net.Dial("tcp", dest)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+
+	reply := []byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0}
+	binary.BigEndian.PutUint16(reply[8:], uint16(d.LocalAddr().(*net.TCPAddr).Port))
+	if _, err := c.Write(reply); err != nil {
+		return
+	}
+
+	go io.Copy(d, c)
+	io.Copy(c, d)
+}
+
+func TestPeerStore(t *testing.T) {
+	s := NewPeerStore()
+
+	s.Put("a", Peer{Trusted: 1})
+	if p, ok := s.Get("a"); !ok || p.Trusted != 1 {
+		t.Fatalf("Get returned %v, %v after Put", p, ok)
+	}
+
+	if s.Update("b", func(p Peer, ok bool) (Peer, bool) { return p, ok }) {
+		t.Fatal("Update wrote a peer it was told not to")
+	}
+	s.Update("a", func(p Peer, ok bool) (Peer, bool) {
+		p.Trusted++
+		return p, true
+	})
+	if p, _ := s.Get("a"); p.Trusted != 2 {
+		t.Fatalf("Update did not modify peer: %v", p)
+	}
+
+	snap := s.Snapshot()
+	s.Delete("a")
+	if _, ok := s.Get("a"); ok {
+		t.Fatal("peer still exists after Delete")
+	}
+	if _, ok := snap["a"]; !ok {
+		t.Fatal("Delete modified a snapshot")
+	}
+	if s.Len() != 0 {
+		t.Fatalf("store has %d peers, expected 0", s.Len())
+	}
+}
+
+func TestPeerStoreChanges(t *testing.T) {
+	s := NewPeerStore()
+
+	s.Put("a", Peer{})
+	s.Put("b", Peer{})
+	since := s.Generation()
+	s.Put("c", Peer{})
+	s.Update("a", func(p Peer, ok bool) (Peer, bool) { return p, true })
+	s.Delete("b")
+
+	changes, gen, complete := s.Changes(since)
+	if !complete || gen != s.Generation() || len(changes) != 3 {
+		t.Fatalf("got %v, %d, %v for changes", changes, gen, complete)
+	}
+	if changes[0].Onion != "c" || changes[1].Onion != "a" ||
+		changes[2].Onion != "b" || !changes[2].Removed {
+		t.Fatalf("changes out of order: %v", changes)
+	}
+
+	// Reappearing peers lose their tombstone.
+	s.Put("b", Peer{})
+	if changes, _, _ := s.Changes(gen); len(changes) != 1 || changes[0].Removed {
+		t.Fatalf("got %v after reappearance", changes)
+	}
+
+	// Once removals are forgotten, only the full view can be given.
+	since = s.Generation()
+	for i := 0; i <= maxTombstones; i++ {
+		s.Put(fmt.Sprint(i), Peer{})
+		s.Delete(fmt.Sprint(i))
+	}
+	changes, _, complete = s.Changes(since)
+	if complete || len(changes) != s.Len() {
+		t.Fatalf("got %d changes, complete %v, after forgetting removals",
+			len(changes), complete)
+	}
+
+	// But a full view can go on past a given generation.
+	if changes, gen := s.Modified(since); len(changes) != 0 || gen != s.Generation() {
+		t.Fatalf("got %v, %d for peers modified since", changes, gen)
+	}
+	s.Put("d", Peer{})
+	if changes, _ := s.Modified(since); len(changes) != 1 || changes[0].Onion != "d" {
+		t.Fatalf("got %v for peers modified since", changes)
+	}
+}
+
+func TestPeerStoreShared(t *testing.T) {
+	s := NewPeerStore()
+	s.shared = func(onion string, p Peer) bool { return p.Trusted >= TrustValidated }
+
+	s.Put("a", Peer{Trusted: TrustGossip})
+	s.Put("a", Peer{Trusted: TrustValidated})
+	shared := s.Generation()
+	s.Put("a", Peer{Trusted: TrustVouched})
+	s.Delete("a")
+
+	changes, _, _ := s.Changes(0)
+	if len(changes) != 1 {
+		t.Fatalf("got %v for changes", changes)
+	}
+	if c := changes[0]; c.sharedAt(shared-1) || !c.sharedAt(shared) ||
+		!c.sharedAt(shared+1) || c.sharedAt(s.Generation()) {
+		t.Fatalf("got share span %v, shared at %d", c.span, shared)
+	}
+}
+
+// TestPeerStoreConcurrent is meant to be run with the race detector
+// (go test -race), hammering the announce handlers and Announce in
+// parallel.
+func TestPeerStoreConcurrent(t *testing.T) {
+	srv := newTestNode(t)
+	srv.Cfg.RateLimit = -1
+	n := newTestNode(t)
+	n.Cfg.TorAddr = startTestServer(t, srv)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(2)
+
+		go func(port int) {
+			defer wg.Done()
+			pk, sk, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			onion := testOnion(pk, port)
+			ret, err := srv.Ann().Init(context.Background(), []string{
+				onion, base64.StdEncoding.EncodeToString(pk), "1234:4321"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			sig := testSign(srv, sk, onion, []string{"1234:4321"}, ret)
+			if _, err := srv.Ann().Validate(context.Background(),
+				[]string{onion, sig}); err != nil {
+				t.Error(err)
+			}
+		}(i + 1)
+
+		go func() {
+			defer wg.Done()
+			// Errors are expected here, as every announce uses the same
+			// onion towards the same server, so their handshakes
+			// supersede each other.
+			n.Announce(context.Background(), srv.Onion)
+		}()
+	}
+	wg.Wait()
+
+	// Whatever the outcome of the above, the stores must be left in a
+	// state that lets us announce again.
+	if err := n.Announce(context.Background(), srv.Onion); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"sync"
+	"time"
+)
+
+// pending is a handshake which was started, but not yet completed. Until it
+// is completed, nothing about it is stored in Peers.
+type pending struct {
+	Pubkey     ed25519.PublicKey // Public key the peer initiated with
+	Portmap    []string          // Portmap the peer initiated with
+	Nonce      string            // The nonce to be signed by the peer
+	Revoke     string            // Revoke key issued upon completion
+	PrevRevoke string            // Revoke key that was valid at initiation
+	Timestamp  int64             // Time the handshake was initiated
+	Difficulty int               // Proof of work difficulty demanded
+	expires    time.Time
+}
+
+// errPendingFull is returned when no more handshakes can be started.
+var errPendingFull = errors.New("too many pending handshakes, try later")
+
+// pendingKey identifies an entry of a pendingTable.
+type pendingKey struct {
+	onion  string // onionaddress:port of the peer
+	pubkey string // Public key the peer initiated with
+}
+
+// pendingTable is a bounded table of pending handshakes, keyed by onion and
+// public key, whose entries expire after a TTL. Handshakes of an onion
+// started with different keys don't interfere, so whoever knows the onion
+// can neither block nor replace the handshake of its owner. Its bounds are
+// taken from cfg.
+type pendingTable struct {
+	mu      sync.Mutex
+	cfg     *Config
+	entries map[pendingKey]pending
+}
+
+func newPendingTable(cfg *Config) *pendingTable {
+	return &pendingTable{cfg: cfg, entries: make(map[pendingKey]pending)}
+}
+
+// put stores a pending handshake for the given onion, replacing a previous
+// one started with the same public key. Expired entries are evicted, and
+// if the table is still full, an error is returned.
+func (t *pendingTable) put(onion string, p pending) error {
+	_, err := t.store(onion, p, false)
+	return err
+}
+
+// reuse is like put, but keeps an unexpired entry started with the same
+// public key, and returns it instead of p. Whoever knows the key can then
+// obtain the entry, but not replace it under its owner.
+func (t *pendingTable) reuse(onion string, p pending) (pending, error) {
+	return t.store(onion, p, true)
+}
+
+// store implements put and reuse.
+func (t *pendingTable) store(onion string, p pending, keep bool) (pending, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range t.entries {
+		if now.After(v.expires) {
+			delete(t.entries, k)
+		}
+	}
+
+	key := pendingKey{onion, string(p.Pubkey)}
+	old, ok := t.entries[key]
+	if ok && keep {
+		return old, nil
+	}
+	if !ok && len(t.entries) >= t.cfg.maxPending() {
+		return p, errPendingFull
+	}
+
+	p.expires = now.Add(t.cfg.pendingTTL())
+	t.entries[key] = p
+	return p, nil
+}
+
+// get returns the pending handshake for the given onion and public key,
+// leaving it in place until it is claimed. It returns an error if there is
+// none, or if it expired, in which case it is dropped.
+func (t *pendingTable) get(onion string, pk ed25519.PublicKey) (pending, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := pendingKey{onion, string(pk)}
+	p, ok := t.entries[key]
+	if !ok {
+		return p, errors.New("no pending handshake")
+	}
+	if time.Now().After(p.expires) {
+		delete(t.entries, key)
+		return p, errors.New("pending handshake expired")
+	}
+	return p, nil
+}
+
+// list returns the pending handshakes for the given onion, whatever key
+// they were started with, leaving them in place until one is claimed. It
+// returns an error if there are none, or if they all expired, in which
+// case they are dropped.
+func (t *pendingTable) list(onion string) ([]pending, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var ret []pending
+	var expired bool
+	now := time.Now()
+	for k, p := range t.entries {
+		if k.onion != onion {
+			continue
+		}
+		if now.After(p.expires) {
+			delete(t.entries, k)
+			expired = true
+			continue
+		}
+		ret = append(ret, p)
+	}
+
+	switch {
+	case len(ret) > 0:
+		return ret, nil
+	case expired:
+		return nil, errors.New("pending handshake expired")
+	}
+	return nil, errors.New("no pending handshake")
+}
+
+// claim removes the pending handshake of the given onion obtained with
+// get or list, once it has been proven. It returns an error if the
+// handshake was claimed or replaced in the meantime, so it can only
+// complete once.
+func (t *pendingTable) claim(onion string, p pending) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := pendingKey{onion, string(p.Pubkey)}
+	cur, ok := t.entries[key]
+	if !ok || cur.Nonce != p.Nonce {
+		return errors.New("no pending handshake")
+	}
+	delete(t.entries, key)
+	return nil
+}
+
+// len returns the number of entries in the table, including expired ones
+// which were not evicted yet.
+func (t *pendingTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.entries)
+}
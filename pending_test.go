@@ -0,0 +1,239 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestPendingTable(t *testing.T) {
+	pt := newPendingTable(&Config{
+		MaxPending: 2,
+		PendingTTL: 50 * time.Millisecond,
+	})
+	if err := pt.put("a", pending{Nonce: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pt.put("b", pending{Nonce: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pt.put("c", pending{Nonce: "c"}); err != errPendingFull {
+		t.Fatalf("expected full table, got %v", err)
+	}
+	// Replacing an entry is always possible.
+	if err := pt.put("a", pending{Nonce: "a2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := pt.get("a", nil)
+	if err != nil || p.Nonce != "a2" {
+		t.Fatalf("got %v (%v), expected a2", p, err)
+	}
+	if err := pt.claim("a", p); err != nil {
+		t.Fatal(err)
+	}
+	if err := pt.claim("a", p); err == nil {
+		t.Fatal("claimed the same entry twice")
+	}
+	if _, err := pt.get("a", nil); err == nil {
+		t.Fatal("got a claimed entry")
+	}
+
+	// A replaced entry can't be claimed with the old one.
+	pt.put("a", pending{Nonce: "a3"})
+	if err := pt.claim("a", pending{Nonce: "a2"}); err == nil {
+		t.Fatal("claimed a replaced entry")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := pt.get("b", nil); err == nil {
+		t.Fatal("got an expired entry")
+	}
+
+	// Expired entries make room for new ones.
+	pt.put("d", pending{})
+	time.Sleep(60 * time.Millisecond)
+	if err := pt.put("e", pending{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pt.put("f", pending{}); err != nil {
+		t.Fatal(err)
+	}
+	if pt.len() != 2 {
+		t.Fatalf("table has %d entries, expected 2", pt.len())
+	}
+}
+
+func TestPendingTableSquatter(t *testing.T) {
+	pt := newPendingTable(&Config{PendingTTL: 50 * time.Millisecond})
+	pk, _, _ := ed25519.GenerateKey(rand.Reader)
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	// Handshakes started with different keys neither block nor replace
+	// each other.
+	if err := pt.put("a", pending{Pubkey: other, Nonce: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pt.put("a", pending{Pubkey: pk, Nonce: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := pt.get("a", pk); p.Nonce != "a" {
+		t.Fatalf("got nonce %q, expected a", p.Nonce)
+	}
+	if p, _ := pt.get("a", other); p.Nonce != "b" {
+		t.Fatalf("got nonce %q, expected b", p.Nonce)
+	}
+	if ps, err := pt.list("a"); err != nil || len(ps) != 2 {
+		t.Fatalf("listed %v (%v), expected 2 entries", ps, err)
+	}
+
+	// Reusing keeps the pending entry of the same key.
+	if p, err := pt.reuse("a", pending{Pubkey: pk, Nonce: "c"}); err != nil || p.Nonce != "a" {
+		t.Fatalf("reused %v (%v), expected a", p, err)
+	}
+	// Putting replaces it.
+	if err := pt.put("a", pending{Pubkey: pk, Nonce: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := pt.get("a", pk); p.Nonce != "c" {
+		t.Fatalf("got nonce %q, expected c", p.Nonce)
+	}
+	if err := pt.claim("a", pending{Pubkey: pk, Nonce: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pt.get("a", other); err != nil {
+		t.Fatal("claim removed the handshake of another key")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := pt.list("a"); err == nil {
+		t.Fatal("listed expired entries")
+	}
+}
+
+func TestPendingHandshake(t *testing.T) {
+	n := newTestNode(t)
+	n.Cfg.PendingTTL = 50 * time.Millisecond
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+	b64pk := base64.StdEncoding.EncodeToString(pk)
+
+	sign := func(ret []string) string {
+		return testSign(n, sk, onion, []string{"1234:4321"}, ret)
+	}
+
+	if _, err := n.Ann().Validate(context.Background(),
+		[]string{onion, sign([]string{"foo", "", "0"})}); err == nil {
+		t.Fatal("validation without init succeeded")
+	}
+
+	ret, err := n.Ann().Init(context.Background(),
+		[]string{onion, b64pk, "1234:4321"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Peers.Len() != 0 {
+		t.Fatal("init created a peer entry")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := n.Ann().Validate(context.Background(),
+		[]string{onion, sign(ret)}); err == nil {
+		t.Fatal("validation of an expired nonce succeeded")
+	}
+	if n.Peers.Len() != 0 {
+		t.Fatal("expired handshake created a peer entry")
+	}
+
+	ret, err = n.Ann().Init(context.Background(),
+		[]string{onion, b64pk, "1234:4321"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Garbage sent by anyone knowing the onion doesn't abort the handshake.
+	if _, err := n.Ann().Validate(context.Background(),
+		[]string{onion, "Z2FyYmFnZQ=="}); err == nil {
+		t.Fatal("validation with a garbage signature succeeded")
+	}
+	if _, err := n.Ann().Validate(context.Background(),
+		[]string{onion, sign(ret)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Ann().Validate(context.Background(),
+		[]string{onion, sign(ret)}); err == nil {
+		t.Fatal("the same signature validated twice")
+	}
+	if p, ok := n.Peers.Get(onion); !ok || p.PeerRevoke != ret[1] {
+		t.Fatal("validation did not create the peer entry")
+	}
+}
+
+func TestPendingHandshakeSquatter(t *testing.T) {
+	n := newTestNode(t)
+	n.Cfg.RateLimit = -1
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fpk, fsk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+
+	// Somebody else starts a handshake for the onion first, and keeps
+	// restarting it.
+	init := func(pk ed25519.PublicKey) []string {
+		ret, err := n.Ann().Init(context.Background(), []string{onion,
+			base64.StdEncoding.EncodeToString(pk), "1234:4321"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	}
+	init(fpk)
+	ret := init(pk)
+	fret := init(fpk)
+
+	if _, err := n.Ann().Validate(context.Background(), []string{onion,
+		testSign(n, sk, onion, []string{"1234:4321"}, ret)}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(onion); !p.Pubkey.Equal(pk) {
+		t.Fatal("owner's handshake did not complete")
+	}
+
+	// The squatter's handshake is superseded by the owner's.
+	if _, err := n.Ann().Validate(context.Background(), []string{onion,
+		testSign(n, fsk, onion, []string{"1234:4321"}, fret)}); err == nil {
+		t.Fatal("squatter's handshake completed after the owner's")
+	}
+	if p, _ := n.Peers.Get(onion); !p.Pubkey.Equal(pk) {
+		t.Fatal("squatter's handshake replaced the owner's key")
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/sha256"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// powTag is the protocol tag and version of the announce proof of work.
+const powTag = "tordam-pow-v1"
+
+// MaxPowDifficulty is the highest difficulty, in leading zero bits, we
+// demand from announcing peers, and are willing to solve when announcing.
+const MaxPowDifficulty = 28
+
+// powDigest returns the hash of a proof of work solution, which binds it to
+// both parties and to the nonce of a single handshake.
+func powDigest(responder, announcer, nonce, solution string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(strings.Join([]string{
+		powTag,
+		responder,
+		announcer,
+		nonce,
+		solution,
+	}, "\n")))
+}
+
+// leadingZeros returns the number of leading zero bits of b.
+func leadingZeros(b []byte) int {
+	var n int
+	for _, i := range b {
+		if i != 0 {
+			return n + bits.LeadingZeros8(i)
+		}
+		n += 8
+	}
+	return n
+}
+
+// checkPow reports whether the given solution satisfies the given
+// difficulty for the handshake of announcer with responder.
+func checkPow(responder, announcer, nonce, solution string, difficulty int) bool {
+	if difficulty <= 0 {
+		return true
+	}
+	if len(solution) > 32 {
+		return false
+	}
+	digest := powDigest(responder, announcer, nonce, solution)
+	return leadingZeros(digest[:]) >= difficulty
+}
+
+// powCheckInterval is the number of hashes solvePow tries between checks
+// of its context.
+const powCheckInterval = 4096
+
+// solvePow finds a solution satisfying the given difficulty for the
+// handshake of announcer with responder. On average, it takes
+// 2^difficulty hashes. It gives up with the error of ctx once ctx is done.
+func solvePow(ctx context.Context, responder, announcer, nonce string, difficulty int) (string, error) {
+	for i := uint64(0); ; i++ {
+		if i%powCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return "", err
+			}
+		}
+		solution := strconv.FormatUint(i, 36)
+		if checkPow(responder, announcer, nonce, solution, difficulty) {
+			return solution, nil
+		}
+	}
+}
+
+// powDifficulty returns the difficulty currently demanded from announcing
+// peers. It rises linearly from Cfg.PowDifficulty to Cfg.PowUnderLoad
+// as the table of pending handshakes fills up.
+func (n *Node) powDifficulty() int {
+	base, max := n.Cfg.PowDifficulty, n.Cfg.PowUnderLoad
+	if max < base {
+		max = base
+	}
+	d := base + (max-base)*n.pendingAnn.len()/n.Cfg.maxPending()
+	if d > MaxPowDifficulty {
+		return MaxPowDifficulty
+	}
+	return d
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPow(t *testing.T) {
+	if n := leadingZeros([]byte{0, 0x10, 0xff}); n != 11 {
+		t.Fatalf("got %d leading zeros, expected 11", n)
+	}
+	if n := leadingZeros([]byte{0, 0}); n != 16 {
+		t.Fatalf("got %d leading zeros, expected 16", n)
+	}
+
+	solution, err := solvePow(context.Background(), "a.onion:1", "b.onion:2", "nonce", 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkPow("a.onion:1", "b.onion:2", "nonce", solution, 12) {
+		t.Fatal("solution does not check out")
+	}
+	// The solution is bound to the handshake. It might check out by
+	// chance, but not for all of these.
+	if checkPow("a.onion:1", "b.onion:2", "other", solution, 12) &&
+		checkPow("b.onion:2", "a.onion:1", "nonce", solution, 12) {
+		t.Fatal("solution checks out for other handshakes")
+	}
+	if !checkPow("a.onion:1", "b.onion:2", "nonce", "", 0) {
+		t.Fatal("no solution needed without difficulty")
+	}
+
+	// Solving gives up with its context, whatever the difficulty.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := solvePow(ctx, "a.onion:1", "b.onion:2", "nonce", 256); err != context.Canceled {
+		t.Fatalf("got %v from a cancelled solve, expected %v", err, context.Canceled)
+	}
+
+	// The difficulty rises with the number of pending handshakes.
+	n := newTestNode(t)
+	n.Cfg.PowDifficulty = 4
+	n.Cfg.PowUnderLoad = 12
+	n.Cfg.MaxPending = 4
+	if d := n.powDifficulty(); d != 4 {
+		t.Fatalf("got difficulty %d without load, expected 4", d)
+	}
+	for i := 0; i < 2; i++ {
+		if err := n.pendingAnn.put(strconv.Itoa(i), pending{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := n.powDifficulty(); d != 8 {
+		t.Fatalf("got difficulty %d at half load, expected 8", d)
+	}
+	n.Cfg.PowUnderLoad = 100
+	if d := n.powDifficulty(); d != MaxPowDifficulty {
+		t.Fatalf("got difficulty %d, expected it capped at %d", d, MaxPowDifficulty)
+	}
+}
+
+func TestValidatePow(t *testing.T) {
+	n := newTestNode(t)
+	n.Cfg.PowDifficulty = 8
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+
+	initAnn := func() []string {
+		ret, err := n.Ann().Init(context.Background(), []string{
+			onion, base64.StdEncoding.EncodeToString(pk), "12345:54321"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	}
+
+	ret := initAnn()
+	if len(ret) != 6 || ret[3] != "" || ret[4] != "" || ret[5] != "8" {
+		t.Fatalf("got %v from ann.Init, expected an unchallenged difficulty", ret)
+	}
+	sig := testSign(n, sk, onion, []string{"12345:54321"}, ret)
+	if _, err := n.Ann().Validate(context.Background(),
+		[]string{onion, sig}); err == nil {
+		t.Fatal("validated without a proof of work")
+	}
+
+	ret = initAnn()
+	sig = testSign(n, sk, onion, []string{"12345:54321"}, ret)
+	solution, err := solvePow(context.Background(), n.Onion, onion, ret[0], 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Ann().Validate(context.Background(),
+		[]string{onion, sig, "", solution}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAnnouncePow(t *testing.T) {
+	srv := newTestNode(t)
+	srv.Cfg.PowDifficulty = 8
+	n := newTestNode(t)
+	n.Cfg.TorAddr = startTestServer(t, srv)
+
+	if err := n.Announce(context.Background(), srv.Onion); err != nil {
+		t.Fatal(err)
+	}
+
+	// Solving the proof of work is bounded by the announce's context.
+	srv.Cfg.PowDifficulty = MaxPowDifficulty
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := n.Announce(ctx, srv.Onion); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %v announcing past the deadline, expected %v", err, ErrTimeout)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/code"
+)
+
+// CodeRateLimited is the JSON-RPC error code returned by the ann handlers
+// to peers calling them too often. The error data is a RateLimitData.
+const CodeRateLimited = code.Code(-32029)
+
+// RateLimitData is the data of a CodeRateLimited error.
+type RateLimitData struct {
+	RetryAfter int `json:"retry_after"` // Seconds until the call may be retried
+}
+
+// maxBuckets is the number of token buckets after which full ones, which
+// are no different from new ones, get evicted.
+const maxBuckets = 4096
+
+// bucket is a token bucket, refilled continuously.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accumulated since the last refill, up to burst.
+func (b *bucket) refill(now time.Time, rate float64, burst int) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+}
+
+// rateLimiter holds a global token bucket and one per peer key, with their
+// rates taken from cfg.
+type rateLimiter struct {
+	mu      sync.Mutex
+	cfg     *Config
+	global  *bucket
+	buckets map[string]*bucket
+}
+
+func newRateLimiter(cfg *Config) *rateLimiter {
+	return &rateLimiter{cfg: cfg, buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token from the global bucket and from the bucket of every
+// given key, if they all have one. Otherwise nothing is taken, and the time
+// until the call would be allowed is returned.
+func (l *rateLimiter) allow(now time.Time, keys ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	grate, gburst := l.cfg.globalRateLimit()
+	rate, burst := l.cfg.rateLimit()
+
+	type limited struct {
+		b     *bucket
+		rate  float64
+		burst int
+	}
+	var check []limited
+
+	if grate > 0 {
+		if l.global == nil {
+			l.global = &bucket{tokens: float64(gburst), last: now}
+		}
+		check = append(check, limited{l.global, grate, gburst})
+	}
+	if rate > 0 {
+		if len(l.buckets) > maxBuckets {
+			l.evict(now, rate, burst)
+		}
+		for _, k := range keys {
+			b, ok := l.buckets[k]
+			if !ok {
+				b = &bucket{tokens: float64(burst), last: now}
+				l.buckets[k] = b
+			}
+			check = append(check, limited{b, rate, burst})
+		}
+	}
+
+	var wait time.Duration
+	for _, c := range check {
+		c.b.refill(now, c.rate, c.burst)
+		if c.b.tokens < 1 {
+			w := time.Duration((1 - c.b.tokens) / c.rate * float64(time.Second))
+			if w > wait {
+				wait = w
+			}
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+
+	for _, c := range check {
+		c.b.tokens--
+	}
+	return 0
+}
+
+// evict removes the buckets which refilled completely. The caller must
+// hold l.mu.
+func (l *rateLimiter) evict(now time.Time, rate float64, burst int) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst) {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// rateLimit returns a CodeRateLimited error if the given peer, identified
+// by its onion address and by its public key if known, or all peers
+// together called the ann handlers too often.
+func (n *Node) rateLimit(onion string, pk []byte) error {
+	host := onion
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	keys := []string{"onion:" + host}
+	if pk != nil {
+		keys = append(keys, "key:"+base64.StdEncoding.EncodeToString(pk))
+	}
+
+	wait := n.limiter.allow(time.Now(), keys...)
+	if wait == 0 {
+		return nil
+	}
+
+	n.rpcWarn(fmt.Sprintf("%s is rate limited", onion))
+	return jrpc2.Errorf(CodeRateLimited, "rate limit exceeded").WithData(
+		RateLimitData{RetryAfter: int(math.Ceil(wait.Seconds()))})
+}
+
+// RetryAfter reports whether err is a peer rate limiting us, and how long
+// we should wait before calling it again.
+func RetryAfter(err error) (time.Duration, bool) {
+	var e *jrpc2.Error
+	if !errors.As(err, &e) || e.Code != CodeRateLimited {
+		return 0, false
+	}
+	var data RateLimitData
+	if err := json.Unmarshal(e.Data, &data); err != nil {
+		return 0, true
+	}
+	return time.Duration(data.RetryAfter) * time.Second, true
+}
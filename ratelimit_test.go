@@ -0,0 +1,122 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	cfg := &Config{
+		RateLimit:       1,
+		RateBurst:       2,
+		GlobalRateLimit: 10,
+		GlobalRateBurst: 3,
+	}
+	l := newRateLimiter(cfg)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if w := l.allow(now, "a"); w != 0 {
+			t.Fatalf("call %d limited for %s", i, w)
+		}
+	}
+	if w := l.allow(now, "a"); w != time.Second {
+		t.Fatalf("burst exceeded, but got a wait of %s", w)
+	}
+
+	// A call limited by one key doesn't use up the tokens of another, nor
+	// the global ones.
+	if w := l.allow(now, "b", "a"); w == 0 {
+		t.Fatal("call limited by one of its keys was allowed")
+	}
+	if w := l.allow(now, "b"); w != 0 {
+		t.Fatalf("call limited for %s", w)
+	}
+
+	// The global bucket is shared by everybody.
+	if w := l.allow(now, "c"); w != 100*time.Millisecond {
+		t.Fatalf("global burst exceeded, but got a wait of %s", w)
+	}
+
+	// Buckets refill with time.
+	now = now.Add(time.Second)
+	if w := l.allow(now, "a"); w != 0 {
+		t.Fatalf("refilled call limited for %s", w)
+	}
+
+	cfg.RateLimit, cfg.GlobalRateLimit = -1, -1
+	for i := 0; i < 100; i++ {
+		if w := l.allow(now, "a"); w != 0 {
+			t.Fatal("call limited with rate limiting disabled")
+		}
+	}
+}
+
+func TestRateLimitAnn(t *testing.T) {
+	n := newTestNode(t)
+	n.Cfg.RateLimit, n.Cfg.RateBurst = 0.001, 2
+
+	pk, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+	vals := []string{onion, base64.StdEncoding.EncodeToString(pk), "12345:54321"}
+
+	for i := 0; i < 2; i++ {
+		if _, err := n.Ann().Init(context.Background(), vals); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = n.Ann().Init(context.Background(), vals)
+	wait, limited := RetryAfter(err)
+	if !limited || wait < 500*time.Second {
+		t.Fatalf("got %v, expected a rate limit with a retry-after hint", err)
+	}
+
+	// Records are not even parsed for limited onions.
+	_, err = n.Ann().Validate(context.Background(), []string{onion, "", "{"})
+	if _, limited := RetryAfter(err); !limited {
+		t.Fatalf("got %v, expected the record to be rate limited", err)
+	}
+
+	// The public key is limited regardless of the onion used.
+	vals[0] = testOnion(pk, 667)
+	if _, err := n.Ann().Init(context.Background(), vals); err == nil {
+		t.Fatal("rate limit evaded by changing the port")
+	}
+	opk, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals[0] = testOnion(opk, 666)
+	if _, err := n.Ann().Init(context.Background(), vals); err == nil {
+		t.Fatal("rate limit evaded by changing the onion")
+	}
+
+	if _, ok := RetryAfter(errors.New("foo")); ok {
+		t.Fatal("plain error taken for a rate limit")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ReapPeers demotes TrustValidated peers which were not seen for
+// Cfg.PeerTTL to TrustGossip, and removes peers which were not seen for
+// Cfg.PeerRemoveTTL from the node's Peers store. Peers vouched for by the
+// operator or pinned are left alone. It returns the number of demoted and
+// removed peers. Revocation keys are kept, so removed peers can still
+// reannounce to us.
+func (n *Node) ReapPeers(now time.Time) (int, int) {
+	demoteBefore := now.Add(-n.Cfg.peerTTL()).Unix()
+	removeBefore := now.Add(-n.Cfg.peerRemoveTTL()).Unix()
+
+	removed := n.Peers.DeleteFunc(func(onion string, peer Peer) bool {
+		return peer.Trusted < TrustVouched && peer.LastSeen < removeBefore
+	})
+
+	stale := func(peer Peer) bool {
+		return peer.Trusted == TrustValidated && peer.LastSeen < demoteBefore
+	}
+
+	var demoted int
+	for onion, peer := range n.Peers.Snapshot() {
+		if !stale(peer) {
+			continue
+		}
+		// The peer might have been seen since the snapshot was taken.
+		if n.Peers.Update(onion, func(peer Peer, ok bool) (Peer, bool) {
+			if !ok || !stale(peer) {
+				return peer, false
+			}
+			peer.Trusted = TrustGossip
+			return peer, true
+		}) {
+			demoted++
+		}
+	}
+
+	return demoted, removed
+}
+
+// RunReaper calls ReapPeers every interval, until ctx is done.
+func (n *Node) RunReaper(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			demoted, removed := n.ReapPeers(now)
+			if demoted > 0 || removed > 0 {
+				n.rpcInfo(fmt.Sprintf("demoted %d and removed %d stale peers",
+					demoted, removed))
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestReapPeers(t *testing.T) {
+	now := time.Now()
+	n := newTestNode(t)
+	n.Peers.Put("fresh", Peer{Trusted: TrustValidated, LastSeen: now.Unix()})
+	n.Peers.Put("stale", Peer{Trusted: TrustValidated, LastSeen: now.Add(-48 * time.Hour).Unix()})
+	n.Peers.Put("dead", Peer{Trusted: TrustValidated, LastSeen: now.Add(-30 * 24 * time.Hour).Unix()})
+	n.Peers.Put("vouched", Peer{Trusted: TrustVouched, LastSeen: now.Add(-30 * 24 * time.Hour).Unix()})
+
+	demoted, removed := n.ReapPeers(now)
+	if demoted != 1 || removed != 1 {
+		t.Fatalf("demoted %d and removed %d, expected 1 and 1", demoted, removed)
+	}
+	if p, _ := n.Peers.Get("fresh"); p.Trusted != TrustValidated {
+		t.Fatal("fresh peer was demoted")
+	}
+	if p, _ := n.Peers.Get("stale"); p.Trusted != TrustGossip {
+		t.Fatal("stale peer was not demoted")
+	}
+	if _, ok := n.Peers.Get("dead"); ok {
+		t.Fatal("dead peer was not removed")
+	}
+	if p, _ := n.Peers.Get("vouched"); p.Trusted != TrustVouched {
+		t.Fatal("vouched peer was reaped")
+	}
+}
+
+func TestValidateFreshness(t *testing.T) {
+	n := newTestNode(t)
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+
+	fpk, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := testOnion(fpk, 1)
+	old := testOnion(fpk, 2)
+	n.Peers.Put(fresh, Peer{Trusted: TrustValidated, LastSeen: time.Now().Unix()})
+	n.Peers.Put(old, Peer{Trusted: TrustValidated,
+		LastSeen: time.Now().Add(-2 * DefaultPeerFreshness).Unix()})
+
+	ret, err := n.Ann().Init(context.Background(), []string{
+		onion, base64.StdEncoding.EncodeToString(pk), "1234:4321"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret, err = n.Ann().Validate(context.Background(), []string{
+		onion, testSign(n, sk, onion, []string{"1234:4321"}, ret)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret) != 1 || ret[0] != fresh {
+		t.Fatalf("got peers %v, expected only %s", ret, fresh)
+	}
+}
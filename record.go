@@ -0,0 +1,153 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recordTag is the protocol tag and version of the PeerRecord encoding.
+const recordTag = "tordam-record-v1"
+
+// maxClockSkew is how far in the future a record or a tombstone we
+// receive may be dated, as the clocks of the peers are not in sync.
+const maxClockSkew = 5 * time.Minute
+
+// maxRecordSize is the maximum size of a JSON encoded PeerRecord we are
+// willing to parse.
+const maxRecordSize = 4096
+
+// PeerRecord is the description a peer publishes about itself, signed with
+// its own key. Records are what gets exchanged between peers, so anyone
+// receiving a relayed record can verify it end to end, without contacting
+// the peer it describes.
+type PeerRecord struct {
+	Onion     string            `json:"onion"`     // onionaddress:port of the peer
+	Pubkey    ed25519.PublicKey `json:"pubkey"`    // Peer's ed25519 public key
+	Portmap   []string          `json:"portmap"`   // Peer's port map in Tor
+	Timestamp int64             `json:"timestamp"` // Time the record was signed
+	Seq       uint64            `json:"seq"`       // Sequence number, higher is newer
+	Signature []byte            `json:"signature"` // Signature over Bytes()
+}
+
+// NewRecord returns a PeerRecord for the given onion and portmap, signed
+// with the given key. Its sequence number is derived from the current
+// time, so every new record supersedes the previous ones.
+func NewRecord(sk ed25519.PrivateKey, onion string, portmap []string) PeerRecord {
+	now := time.Now()
+	r := PeerRecord{
+		Onion:     onion,
+		Pubkey:    sk.Public().(ed25519.PublicKey),
+		Portmap:   portmap,
+		Timestamp: now.Unix(),
+		Seq:       uint64(now.UnixNano()),
+	}
+	r.Signature = ed25519.Sign(sk, r.Bytes())
+	return r
+}
+
+// Bytes returns the canonical encoding of the record, which is what gets
+// signed and verified. The signature itself is not part of it.
+func (r PeerRecord) Bytes() []byte {
+	return []byte(strings.Join([]string{
+		recordTag,
+		r.Onion,
+		base64.StdEncoding.EncodeToString(r.Pubkey),
+		strings.Join(r.Portmap, ","),
+		strconv.FormatInt(r.Timestamp, 10),
+		strconv.FormatUint(r.Seq, 10),
+	}, "\n"))
+}
+
+// Verify checks the record is well formed and signed by its own public
+// key.
+func (r PeerRecord) Verify() error {
+	if err := ValidateOnionInternal(r.Onion); err != nil {
+		return err
+	}
+	if len(r.Pubkey) != ed25519.PublicKeySize {
+		return errors.New("invalid record public key")
+	}
+	if err := ValidatePortmap(r.Portmap); err != nil {
+		return err
+	}
+	if !ed25519.Verify(r.Pubkey, r.Bytes(), r.Signature) {
+		return fmt.Errorf("invalid record signature for %s", r.Onion)
+	}
+	return nil
+}
+
+// String returns the JSON encoding of the record, as exchanged in the
+// announce RPC.
+func (r PeerRecord) String() string {
+	data, _ := json.Marshal(r)
+	return string(data)
+}
+
+// ParseRecord parses and verifies a JSON encoded PeerRecord.
+func ParseRecord(s string) (PeerRecord, error) {
+	var r PeerRecord
+	if len(s) > maxRecordSize {
+		return r, errors.New("peer record too large")
+	}
+	if err := json.Unmarshal([]byte(s), &r); err != nil {
+		return r, errors.New("invalid peer record")
+	}
+	return r, r.Verify()
+}
+
+// parseRecord parses and verifies a JSON encoded PeerRecord received by
+// the node. Records dated further than maxClockSkew in the future are
+// refused, as they would never go stale, and so are records whose sequence
+// number lies further in the future, as NewRecord derives it from the time
+// and it would never be superseded. With Cfg.BindOnionKey, the public key
+// must also be the onion key.
+func (n *Node) parseRecord(s string) (PeerRecord, error) {
+	r, err := ParseRecord(s)
+	if err != nil {
+		return r, err
+	}
+	limit := time.Now().Add(maxClockSkew)
+	if r.Timestamp > limit.Unix() || r.Seq > uint64(limit.UnixNano()) {
+		return r, fmt.Errorf("record of %s is dated in the future", r.Onion)
+	}
+	if !n.Cfg.BindOnionKey {
+		return r, nil
+	}
+	opk, err := OnionPubkey(r.Onion)
+	if err != nil {
+		return r, err
+	}
+	if !opk.Equal(r.Pubkey) {
+		return r, fmt.Errorf("record of %s holds a foreign key", r.Onion)
+	}
+	return r, nil
+}
+
+// isRecord reports whether the given peer list entry is a PeerRecord
+// rather than a bare onion address.
+func isRecord(s string) bool {
+	return strings.HasPrefix(s, "{")
+}
@@ -0,0 +1,341 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPeerRecord(t *testing.T) {
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, fsk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+
+	rec := NewRecord(sk, onion, []string{"12345:54321"})
+	r, err := ParseRecord(rec.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Onion != onion || !r.Pubkey.Equal(pk) || r.Seq != rec.Seq {
+		t.Fatalf("record did not survive encoding: %v", r)
+	}
+
+	if NewRecord(sk, onion, nil).Seq <= rec.Seq {
+		t.Fatal("newer record has a lower sequence number")
+	}
+
+	tampered := rec
+	tampered.Portmap = []string{"1:1"}
+	if err := tampered.Verify(); err == nil {
+		t.Fatal("tampered record verified")
+	}
+	if _, err := ParseRecord("{" + strings.Repeat(" ", maxRecordSize) + "}"); err == nil {
+		t.Fatal("oversized record was parsed")
+	}
+	if _, err := ParseRecord("{garbage"); err == nil {
+		t.Fatal("garbage record was parsed")
+	}
+
+	// A record signed by a key other than the onion key is only fine if
+	// the keys are not bound.
+	n := newTestNode(t)
+	foreign := NewRecord(fsk, onion, nil)
+	if _, err := n.parseRecord(foreign.String()); err != nil {
+		t.Fatal(err)
+	}
+	n.Cfg.BindOnionKey = true
+	if _, err := n.parseRecord(foreign.String()); err == nil {
+		t.Fatal("record with a foreign key verified with Cfg.BindOnionKey")
+	}
+	if _, err := n.parseRecord(rec.String()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAppendRecords(t *testing.T) {
+	n := newTestNode(t)
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fpk, fsk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+
+	old := NewRecord(sk, onion, []string{"1:1"})
+	old.Timestamp = time.Now().Add(-time.Hour).Unix()
+	old.Signature = ed25519.Sign(sk, old.Bytes())
+	rec := NewRecord(sk, onion, []string{"2:2"})
+
+	if err := n.AppendPeers([]string{rec.String()}); err != nil {
+		t.Fatal(err)
+	}
+	p, ok := n.Peers.Get(onion)
+	if !ok || p.Record == nil || p.Record.Seq != rec.Seq ||
+		p.Portmap[0] != "2:2" || p.Trusted != TrustGossip {
+		t.Fatalf("record was not appended: %v", p)
+	}
+	if p.Pubkey != nil {
+		t.Fatal("relayed record set the proven public key")
+	}
+
+	// Older records never replace newer ones.
+	if err := n.AppendPeers([]string{old.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(onion); p.Record.Seq != rec.Seq {
+		t.Fatal("older record replaced a newer one")
+	}
+
+	// The record's timestamp is what makes a peer fresh.
+	other := testOnion(fpk, 666)
+	stale := NewRecord(fsk, other, nil)
+	stale.Timestamp = time.Now().Add(-time.Hour).Unix()
+	stale.Signature = ed25519.Sign(fsk, stale.Bytes())
+	if err := n.AppendPeers([]string{stale.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(other); p.LastSeen != stale.Timestamp {
+		t.Fatalf("peer last seen at %d, expected %d", p.LastSeen, stale.Timestamp)
+	}
+
+	// Records can't override a key the peer proved to us.
+	n.Peers.Update(onion, func(p Peer, ok bool) (Peer, bool) {
+		p.Pubkey = pk
+		return p, ok
+	})
+	forged := NewRecord(fsk, onion, []string{"3:3"})
+	if err := n.AppendPeers([]string{forged.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(onion); p.Record.Seq != rec.Seq {
+		t.Fatal("record with a foreign key was appended")
+	}
+
+	// Unsigned records are dropped.
+	bad := NewRecord(fsk, testOnion(fpk, 1), nil)
+	bad.Signature = nil
+	if err := n.AppendPeers([]string{bad.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := n.Peers.Get(bad.Onion); ok {
+		t.Fatal("unsigned record was appended")
+	}
+}
+
+func TestValidateRecords(t *testing.T) {
+	n := newTestNode(t)
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpk, rsk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+	relayed := NewRecord(rsk, testOnion(rpk, 666), nil)
+	bare := testOnion(rpk, 1)
+
+	if err := n.AppendPeers([]string{relayed.String(), bare}); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []string{relayed.Onion, bare} {
+		if err := n.SetTrust(i, TrustValidated); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var revoke string
+	validate := func(extra ...string) ([]string, error) {
+		vals := []string{onion, base64.StdEncoding.EncodeToString(pk),
+			"12345:54321", revoke}
+		ret, err := n.Ann().Init(context.Background(), vals)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vals = []string{onion, testSign(n, sk, onion, []string{"12345:54321"}, ret)}
+		peers, err := n.Ann().Validate(context.Background(), append(vals, extra...))
+		if err == nil {
+			revoke = ret[1]
+		}
+		return peers, err
+	}
+
+	// Peers not sending their record get bare onions.
+	ret, err := validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range ret {
+		if isRecord(i) {
+			t.Fatal("record sent to a peer not sending its own")
+		}
+	}
+
+	// A record of somebody else is refused.
+	if _, err := validate(relayed.String()); err == nil {
+		t.Fatal("foreign record accepted")
+	}
+
+	rec := NewRecord(sk, onion, []string{"12345:54321"})
+	ret, err = validate(rec.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records, onions int
+	for _, i := range ret {
+		if !isRecord(i) {
+			onions++
+			continue
+		}
+		r, err := ParseRecord(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Onion == relayed.Onion {
+			records++
+		}
+	}
+	if records != 1 || onions != 1 {
+		t.Fatalf("got %d records and %d onions, expected 1 and 1", records, onions)
+	}
+
+	if p, _ := n.Peers.Get(onion); p.Record == nil || p.Record.Seq != rec.Seq {
+		t.Fatal("validated peer's record was not stored")
+	}
+}
+
+// forgeRecord returns a record of the given onion signed with a key of
+// its own, dated a minute ago, with the highest sequence number accepted.
+func forgeRecord(t *testing.T, onion string) PeerRecord {
+	_, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRecord(sk, onion, nil)
+	r.Timestamp = time.Now().Add(-time.Minute).Unix()
+	r.Seq = uint64(time.Now().Add(maxClockSkew / 2).UnixNano())
+	r.Signature = ed25519.Sign(sk, r.Bytes())
+	return r
+}
+
+func TestAppendForgedRecord(t *testing.T) {
+	n := newTestNode(t)
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+
+	// Sequence numbers can't be pinned at the maximum.
+	pinned := NewRecord(sk, onion, nil)
+	pinned.Seq = math.MaxUint64
+	pinned.Signature = ed25519.Sign(sk, pinned.Bytes())
+	if err := n.AppendPeers([]string{pinned.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := n.Peers.Get(onion); ok {
+		t.Fatal("record with the highest sequence number was appended")
+	}
+
+	// A forged record doesn't block the newer one of the owner, whatever
+	// its sequence number.
+	forged := forgeRecord(t, onion)
+	if err := n.AppendPeers([]string{forged.String()}); err != nil {
+		t.Fatal(err)
+	}
+	rec := NewRecord(sk, onion, nil)
+	if err := n.AppendPeers([]string{rec.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(onion); p.Record == nil || !p.Record.Pubkey.Equal(pk) {
+		t.Fatal("forged record blocked the owner's record")
+	}
+	if err := n.AppendPeers([]string{forged.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(onion); !p.Record.Pubkey.Equal(pk) {
+		t.Fatal("older forged record replaced the owner's record")
+	}
+}
+
+func TestValidateForgedRecord(t *testing.T) {
+	n := newTestNode(t)
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+
+	forged := forgeRecord(t, onion)
+	if err := n.AppendPeers([]string{forged.String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	ret, err := n.Ann().Init(context.Background(), []string{onion,
+		base64.StdEncoding.EncodeToString(pk), "12345:54321"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := NewRecord(sk, onion, []string{"12345:54321"})
+	if _, err := n.Ann().Validate(context.Background(), []string{onion,
+		testSign(n, sk, onion, []string{"12345:54321"}, ret),
+		rec.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(onion); p.Record == nil || !p.Record.Pubkey.Equal(pk) {
+		t.Fatal("forged record survived the peer's handshake")
+	}
+}
+
+func TestAnnounceForgedRecord(t *testing.T) {
+	srv := newTestNode(t)
+	n := newTestNode(t)
+	n.Cfg.TorAddr = startTestServer(t, srv)
+
+	forged := forgeRecord(t, srv.Onion)
+	if err := n.AppendPeers([]string{forged.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Announce(context.Background(), srv.Onion); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(srv.Onion); p.Record != nil {
+		t.Fatal("forged record survived the peer proving its key")
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// RevokeDBVersion is the current version of the on-disk revocation key
+// database format.
+const RevokeDBVersion = 1
+
+// RevokeKeys holds the revocation keys shared with a single peer.
+type RevokeKeys struct {
+	Self    string `json:"self,omitempty"` // Revoke key the peer issued to us
+	Peer    string `json:"peer,omitempty"` // Revoke key we issued to the peer
+	Updated int64  `json:"updated"`        // Timestamp of last change
+}
+
+// RevokeStore is a concurrency-safe keyring of revocation keys, keyed by
+// onionaddress:port. Unlike the peer database, which is written lazily, a
+// RevokeStore backed by a file writes it on every change, since losing a
+// revocation key locks us out of a peer.
+type RevokeStore struct {
+	mu   sync.Mutex
+	file string
+	keys map[string]RevokeKeys
+}
+
+// revokeDB is the on-disk representation of a RevokeStore.
+type revokeDB struct {
+	Version int                   `json:"version"`
+	Keys    map[string]RevokeKeys `json:"keys"`
+}
+
+// NewRevokeStore returns an empty RevokeStore which is only kept in memory.
+func NewRevokeStore() *RevokeStore {
+	return &RevokeStore{keys: make(map[string]RevokeKeys)}
+}
+
+// OpenRevokeStore returns a RevokeStore backed by the given file, loading
+// any keys already found in it.
+func OpenRevokeStore(file string) (*RevokeStore, error) {
+	r := NewRevokeStore()
+	r.file = file
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var db revokeDB
+	if err := json.Unmarshal(data, &db); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if db.Version != RevokeDBVersion {
+		return nil, fmt.Errorf("%s: unsupported revoke db version %d",
+			file, db.Version)
+	}
+	if db.Keys != nil {
+		r.keys = db.Keys
+	}
+
+	return r, nil
+}
+
+// Get returns the revocation keys stored for the given onion address, and
+// whether any were found.
+func (r *RevokeStore) Get(onion string) (RevokeKeys, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k, ok := r.keys[onion]
+	return k, ok
+}
+
+// SetSelf stores the revoke key the given peer issued to us.
+func (r *RevokeStore) SetSelf(onion, key string) error {
+	return r.update(onion, func(k *RevokeKeys) { k.Self = key })
+}
+
+// SetPeer stores the revoke key we issued to the given peer.
+func (r *RevokeStore) SetPeer(onion, key string) error {
+	return r.update(onion, func(k *RevokeKeys) { k.Peer = key })
+}
+
+func (r *RevokeStore) update(onion string, fn func(*RevokeKeys)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := r.keys[onion]
+	fn(&k)
+	k.Updated = time.Now().Unix()
+	r.keys[onion] = k
+	return r.save()
+}
+
+// Delete removes all revocation keys stored for the given onion address.
+func (r *RevokeStore) Delete(onion string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.keys[onion]; !ok {
+		return nil
+	}
+	delete(r.keys, onion)
+	return r.save()
+}
+
+// Snapshot returns a copy of all stored revocation keys.
+func (r *RevokeStore) Snapshot() map[string]RevokeKeys {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := make(map[string]RevokeKeys, len(r.keys))
+	for onion, k := range r.keys {
+		ret[onion] = k
+	}
+	return ret
+}
+
+// save writes the keyring to its file, if it has one. The caller must
+// hold r.mu.
+func (r *RevokeStore) save() error {
+	if r.file == "" {
+		return nil
+	}
+	data, err := json.Marshal(revokeDB{Version: RevokeDBVersion, Keys: r.keys})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(r.file, data, 0600)
+}
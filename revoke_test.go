@@ -0,0 +1,107 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRevokeStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tordam-revoke")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "revoke.json")
+
+	const onion = "p7qaewjgnvnaeihhyybmoofd5avh665kr3awoxlh5rt6ox743kjdr6qd.onion:666"
+
+	r, err := OpenRevokeStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetSelf(onion, "self"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetPeer(onion, "peer"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = OpenRevokeStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, ok := r.Get(onion); !ok || k.Self != "self" || k.Peer != "peer" {
+		t.Fatalf("reloaded keys do not match: %v", k)
+	}
+
+	if err := r.Delete(onion); err != nil {
+		t.Fatal(err)
+	}
+	r, err = OpenRevokeStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Get(onion); ok {
+		t.Fatal("deleted keys were reloaded")
+	}
+}
+
+// TestRevokeReannounce checks that we can reannounce to a peer after
+// losing the peer store, as long as the keyring survived.
+func TestRevokeReannounce(t *testing.T) {
+	srv := newTestNode(t)
+	n := newTestNode(t)
+	n.Cfg.TorAddr = startTestServer(t, srv)
+
+	dir, err := ioutil.TempDir("", "tordam-revoke")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "revoke.json")
+
+	if n.Revokes, err = OpenRevokeStore(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Announce(context.Background(), srv.Onion); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a restart which lost the peer db.
+	n.Peers = NewPeerStore()
+	if n.Revokes, err = OpenRevokeStore(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Announce(context.Background(), srv.Onion); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the keyring, and without a key to recover with, the remote
+	// must refuse us.
+	n.Peers = NewPeerStore()
+	n.Revokes = NewRevokeStore()
+	srv.Peers.Put(n.Onion, Peer{PeerRevoke: "foo"})
+	if err := n.Announce(context.Background(), srv.Onion); err == nil {
+		t.Fatal("announce without revocation key succeeded")
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/creachadair/jrpc2"
+)
+
+// rotateTag is the protocol tag and version of the Rotation encoding.
+const rotateTag = "tordam-rotate-v1"
+
+// Rotation is the statement of a peer replacing its signing key. The old
+// key endorses the new one, and the new key proves it is held by the same
+// peer, so nobody can have their key endorsed by somebody else.
+type Rotation struct {
+	Onion     string            `json:"onion"`     // onionaddress:port of the peer
+	OldKey    ed25519.PublicKey `json:"oldkey"`    // Key being replaced
+	NewKey    ed25519.PublicKey `json:"newkey"`    // Key replacing it
+	Timestamp int64             `json:"timestamp"` // Time of the rotation
+	OldSig    []byte            `json:"oldsig"`    // Signature over Bytes() by OldKey
+	NewSig    []byte            `json:"newsig"`    // Signature over Bytes() by NewKey
+}
+
+// NewRotation returns a Rotation of the given onion's key from oldsk to
+// newsk, signed by both.
+func NewRotation(oldsk, newsk ed25519.PrivateKey, onion string) Rotation {
+	r := Rotation{
+		Onion:     onion,
+		OldKey:    oldsk.Public().(ed25519.PublicKey),
+		NewKey:    newsk.Public().(ed25519.PublicKey),
+		Timestamp: time.Now().Unix(),
+	}
+	r.OldSig = ed25519.Sign(oldsk, r.Bytes())
+	r.NewSig = ed25519.Sign(newsk, r.Bytes())
+	return r
+}
+
+// Bytes returns the canonical encoding of the rotation, which is what gets
+// signed and verified.
+func (r Rotation) Bytes() []byte {
+	return []byte(strings.Join([]string{
+		rotateTag,
+		r.Onion,
+		base64.StdEncoding.EncodeToString(r.OldKey),
+		base64.StdEncoding.EncodeToString(r.NewKey),
+		strconv.FormatInt(r.Timestamp, 10),
+	}, "\n"))
+}
+
+// Verify checks the rotation is well formed and signed by both keys.
+func (r Rotation) Verify() error {
+	if err := ValidateOnionInternal(r.Onion); err != nil {
+		return err
+	}
+	if len(r.OldKey) != ed25519.PublicKeySize ||
+		len(r.NewKey) != ed25519.PublicKeySize {
+		return errors.New("invalid rotation public key")
+	}
+	if r.OldKey.Equal(r.NewKey) {
+		return errors.New("rotation to the same key")
+	}
+	if !ed25519.Verify(r.OldKey, r.Bytes(), r.OldSig) ||
+		!ed25519.Verify(r.NewKey, r.Bytes(), r.NewSig) {
+		return fmt.Errorf("invalid rotation signature for %s", r.Onion)
+	}
+	return nil
+}
+
+// String returns the JSON encoding of the rotation, as sent to ann.Rotate.
+func (r Rotation) String() string {
+	data, _ := json.Marshal(r)
+	return string(data)
+}
+
+// ParseRotation parses and verifies a JSON encoded Rotation.
+func ParseRotation(s string) (Rotation, error) {
+	var r Rotation
+	if len(s) > maxRecordSize {
+		return r, errors.New("rotation too large")
+	}
+	if err := json.Unmarshal([]byte(s), &r); err != nil {
+		return r, errors.New("invalid rotation")
+	}
+	return r, r.Verify()
+}
+
+// Rotate pushes the given Rotation of our key to the peer at the given
+// onion address, so it replaces the key it knows for us. A peer which
+// already applied the rotation counts as a success, so a rotation can be
+// pushed again to all peers when some missed it. It gives up once ctx is
+// done.
+func (n *Node) Rotate(ctx context.Context, onionaddr string, r Rotation) error {
+	n.rpcInfo(fmt.Sprintf("Pushing key rotation to %s", onionaddr))
+
+	if err := ValidateOnionInternal(onionaddr); err != nil {
+		return err
+	}
+
+	cli, err := n.Dial(ctx, onionaddr)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	if err := cli.Rotate(ctx, r); err != nil && !isRotatedError(err) {
+		return err
+	}
+	return nil
+}
+
+// isRotatedError reports whether err is a peer refusing a rotation because
+// it already applied it.
+func isRotatedError(err error) bool {
+	var e *jrpc2.Error
+	return errors.As(err, &e) && e.Message == "rotation was already applied"
+}
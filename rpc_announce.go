@@ -18,133 +18,224 @@
 package tordam
 
 import (
+	"bytes"
 	"context"
 	"crypto/ed25519"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 )
 
-// Ann is the struct for the JSON-RPC announce endpoint.
-type Ann struct{}
+// Ann is the struct for the JSON-RPC announce endpoint of a Node, as
+// returned by Node.Ann.
+type Ann struct {
+	*Node
+}
 
 // Init takes three parameters:
 // - onion: onionaddress:port where the peer and tordam can be reached
 // - pubkey: ed25519 public signing key in base64
 // - portmap: List of ports available for communication
-// - (optional) revoke: Revocation key for updating peer info
+// - (optional) revoke: Revocation key for updating peer info, may be empty
+// - (optional) challenge: Random challenge for us to prove our identity
 //  {
 //   "jsonrpc":"2.0",
 //   "id": 1,
 //   "method": "ann.Init",
-//   "params": ["unlikelynameforan.onion:49371", "214=", "69:420,323:2354"]
+//   "params": ["unlikelynameforan.onion:49371", "214=", "69:420,323:2354",
+//              "", "somechallenge"]
 //  }
 // Returns:
 // - nonce: A random nonce which is to be signed by the client
 // - revoke: A key which can be used to revoke key and portmap and reannounce the peer
+// - timestamp: The time the nonce was issued, as part of the Challenge
+// - (if challenged) pubkey: Our ed25519 public signing key in base64
+// - (if challenged) signature: base64 signature of the Proof built from
+//   the given challenge
+// - (if demanded) difficulty: The number of leading zero bits the proof of
+//   work submitted to Validate must have, with the previous two elements
+//   left empty if we were not challenged
 //  {
 //   "jsonrpc":"2.0",
 //   "id":1,
-//   "result": ["somenonce", "somerevokekey"]
+//   "result": ["somenonce", "somerevokekey", "1618000000", "214=",
+//              "deadbeef=="]
 //  }
+// The handshake is kept pending, and nothing about the peer is stored until
+// it is completed with Validate within Cfg.PendingTTL. Only then does the
+// revoke key become valid.
 // On any kind of failure returns an error and the reason.
-func (Ann) Init(ctx context.Context, vals []string) ([]string, error) {
-	if len(vals) != 3 && len(vals) != 4 {
+func (a Ann) Init(ctx context.Context, vals []string) ([]string, error) {
+	if len(vals) < 3 || len(vals) > 5 {
 		return nil, errors.New("invalid parameters")
 	}
 
 	onion := vals[0]
 	pubkey := vals[1]
 	portmap := strings.Split(vals[2], ",")
+	var revoke, challenge string
+	if len(vals) > 3 {
+		revoke = vals[3]
+	}
+	if len(vals) > 4 {
+		challenge = vals[4]
+		if len(challenge) > 256 || strings.ContainsAny(challenge, "\n") {
+			a.rpcWarn("got invalid challenge")
+			return nil, errors.New("invalid challenge")
+		}
+	}
 
 	if err := ValidateOnionInternal(onion); err != nil {
-		rpcWarn(err.Error())
+		a.rpcWarn(err.Error())
 		return nil, err
 	}
 
-	rpcInfo(fmt.Sprintf("got request for %s", onion))
+	a.rpcInfo(fmt.Sprintf("got request for %s", onion))
 
-	var peer Peer
-	reallySeen := false
-	peer, ok := Peers[onion]
-	if ok {
-		// We have seen this peer
-		if peer.Pubkey != nil || peer.PeerRevoke != "" {
-			reallySeen = true
-		}
+	pk, err := base64.StdEncoding.DecodeString(pubkey)
+	if err != nil {
+		a.rpcWarn("got invalid base64 public key")
+		return nil, errors.New("invalid base64 public key")
+	} else if len(pk) != 32 {
+		a.rpcWarn("got invalid pubkey (len != 32)")
+		return nil, errors.New("invalid public key")
 	}
 
-	if reallySeen {
-		// Peer announced to us before
-		if len(vals) != 4 {
-			rpcWarn("no revocation key provided")
-			return nil, errors.New("no revocation key provided")
+	if err := a.rateLimit(onion, pk); err != nil {
+		return nil, err
+	}
+
+	if a.Cfg.BindOnionKey {
+		opk, err := OnionPubkey(onion)
+		if err != nil {
+			a.rpcWarn(err.Error())
+			return nil, err
 		}
-		revoke := vals[3]
-		if strings.Compare(revoke, peer.PeerRevoke) != 0 {
-			rpcWarn("revocation key doesn't match")
-			return nil, errors.New("revocation key doesn't match")
+		if !bytes.Equal(opk, pk) {
+			a.rpcWarn(fmt.Sprintf("%s announced with a foreign key", onion))
+			return nil, errors.New("public key doesn't match onion address")
 		}
 	}
 
-	pk, err := base64.StdEncoding.DecodeString(pubkey)
-	if err != nil {
-		rpcWarn("got invalid base64 public key")
-		return nil, errors.New("invalid base64 public key")
-	} else if len(pk) != 32 {
-		rpcWarn("got invalid pubkey (len != 32)")
-		return nil, errors.New("invalid public key")
+	if !a.Access.Permitted(onion, pk) {
+		a.rpcWarn(fmt.Sprintf("%s is blocked", onion))
+		return nil, errors.New("access denied")
 	}
 
 	if err := ValidatePortmap(portmap); err != nil {
-		rpcWarn(err.Error())
+		a.rpcWarn(err.Error())
 		return nil, err
 	}
 
 	nonce, err := RandomGarbage(32)
 	if err != nil {
-		rpcInternalErr(err.Error())
+		a.rpcInternalErr(err.Error())
 		return nil, errors.New("internal error")
 	}
 
 	newrevoke, err := RandomGarbage(128)
 	if err != nil {
-		rpcInternalErr(err.Error())
+		a.rpcInternalErr(err.Error())
 		return nil, errors.New("internal error")
 	}
 
-	peer.Pubkey = pk
-	peer.Portmap = portmap
-	peer.Nonce = nonce
-	peer.PeerRevoke = newrevoke
-	peer.LastSeen = time.Now().Unix()
-	peer.Trusted = 0
-	Peers[onion] = peer
+	// Peer announced to us before, so it has to prove it is the same peer.
+	prevrevoke, seen := a.peerRevoke(onion)
+	if seen {
+		if revoke == "" {
+			a.rpcWarn("no revocation key provided")
+			return nil, errors.New("no revocation key provided")
+		}
+		if strings.Compare(revoke, prevrevoke) != 0 {
+			a.rpcWarn("revocation key doesn't match")
+			return nil, errors.New("revocation key doesn't match")
+		}
+	}
+
+	// Nothing is stored in Peers until the handshake is completed with
+	// Validate.
+	now := time.Now().Unix()
+	difficulty := a.powDifficulty()
+	if err := a.pendingAnn.put(onion, pending{
+		Pubkey:     pk,
+		Portmap:    portmap,
+		Nonce:      nonce,
+		Revoke:     newrevoke,
+		PrevRevoke: prevrevoke,
+		Timestamp:  now,
+		Difficulty: difficulty,
+	}); err != nil {
+		a.rpcWarn(err.Error())
+		return nil, err
+	}
 
-	return []string{nonce, newrevoke}, nil
+	ret := []string{nonce, newrevoke, strconv.FormatInt(now, 10)}
+
+	if challenge != "" {
+		// The announcer wants us to prove who we are.
+		proof := Proof{
+			Responder: a.Onion,
+			Announcer: onion,
+			Challenge: challenge,
+			Timestamp: now,
+		}
+		ret = append(ret,
+			base64.StdEncoding.EncodeToString(a.SignKey.Public().(ed25519.PublicKey)),
+			base64.StdEncoding.EncodeToString(ed25519.Sign(a.SignKey, proof.Bytes())),
+		)
+	}
+
+	if difficulty > 0 {
+		for len(ret) < 5 {
+			ret = append(ret, "")
+		}
+		ret = append(ret, strconv.Itoa(difficulty))
+	}
+
+	return ret, nil
+}
+
+// peerRevoke returns the revoke key we issued to the given peer, and
+// whether the peer ever completed an announce to us. The peer db may have
+// been lost while the keyring was not, so the keyring is consulted too.
+func (n *Node) peerRevoke(onion string) (string, bool) {
+	peer, ok := n.Peers.Get(onion)
+	revoke := peer.PeerRevoke
+	if revoke == "" {
+		k, _ := n.Revokes.Get(onion)
+		revoke = k.Peer
+	}
+	return revoke, (ok && peer.Pubkey != nil) || revoke != ""
 }
 
-// Validate takes two parameters:
+// Validate takes two to four parameters:
 // - onion: onionaddress:port where the peer and tordam can be reached
-// - signature: base64 signature of the previously obtained nonce
+// - signature: base64 signature of the Challenge built from the previously
+//   obtained nonce (or of the bare nonce, if Cfg.LegacyChallenge is set)
+// - record: (optional) the peer's own PeerRecord, JSON encoded, may be empty
+// - solution: (optional) the proof of work, if Init demanded one
 //  {
 //   "jsonrpc":"2.0",
 //   "id":2,
 //   "method": "ann.Announce",
-//   "params": ["unlikelynameforan.onion:49371", "deadbeef=="]
+//   "params": ["unlikelynameforan.onion:49371", "deadbeef==", "{...}", "1a2b"]
 //  }
 // Returns:
-// - peers: A list of known validated peers (max. 50)
+// - peers: A list of known peers trusted at least Cfg.ShareTrust and seen
+//   within Cfg.PeerFreshness, as selected by the SharePolicy for the
+//   peer's trust level. If the peer sent its record, the peers are
+//   given as their JSON encoded PeerRecord where one is known.
 //  {
 //   "jsonrpc":"2.0",
 //   "id":2,
-//   "result": ["unlikelynameforan.onion:69", "yetanother.onion:420"]
+//   "result": ["unlikelynameforan.onion:69", "{\"onion\":...}"]
 //  }
 // On any kind of failure returns an error and the reason.
-func (Ann) Validate(ctx context.Context, vals []string) ([]string, error) {
-	if len(vals) != 2 {
+func (a Ann) Validate(ctx context.Context, vals []string) ([]string, error) {
+	if len(vals) < 2 || len(vals) > 4 {
 		return nil, errors.New("invalid parameters")
 	}
 
@@ -152,49 +243,197 @@ func (Ann) Validate(ctx context.Context, vals []string) ([]string, error) {
 	signature := vals[1]
 
 	if err := ValidateOnionInternal(onion); err != nil {
-		rpcWarn(err.Error())
+		a.rpcWarn(err.Error())
 		return nil, err
 	}
 
-	rpcInfo(fmt.Sprintf("got request for %s", onion))
+	a.rpcInfo(fmt.Sprintf("got request for %s", onion))
 
-	peer, ok := Peers[onion]
-	if !ok {
-		rpcWarn(fmt.Sprintf("%s not in peer map", onion))
-		return nil, errors.New("this onion was not seen before")
+	if err := a.rateLimit(onion, nil); err != nil {
+		return nil, err
 	}
 
-	if peer.Pubkey == nil || peer.Nonce == "" {
-		rpcWarn(fmt.Sprintf("%s tried to validate before init", onion))
-		return nil, errors.New("tried to validate before init")
+	// The record is only parsed and verified once the request passed the
+	// rate limit, as doing so is comparatively expensive.
+	var rec *PeerRecord
+	if len(vals) > 2 && vals[2] != "" {
+		r, err := a.parseRecord(vals[2])
+		if err != nil {
+			a.rpcWarn(fmt.Sprintf("%s: %v", onion, err))
+			return nil, err
+		}
+		if r.Onion != onion {
+			a.rpcWarn(fmt.Sprintf("%s sent a record of %s", onion, r.Onion))
+			return nil, errors.New("peer record doesn't match onion address")
+		}
+		rec = &r
 	}
 
 	sig, err := base64.StdEncoding.DecodeString(signature)
 	if err != nil {
-		rpcWarn("invalid base64 signature string")
+		a.rpcWarn("invalid base64 signature string")
 		return nil, errors.New("invalid base64 signature string")
 	}
 
-	if !ed25519.Verify(peer.Pubkey, []byte(peer.Nonce), sig) {
-		rpcWarn("signature verification failed")
-		// delete(Peers, onion)
-		return nil, errors.New("signature verification failed")
+	// The pending handshake is only consumed once it was proven, so that
+	// garbage sent by anyone else doesn't abort it. Anyone may have started
+	// a handshake for the onion with their own key, so the one proven by
+	// the signature is the peer's.
+	ps, err := a.pendingAnn.list(onion)
+	if err != nil {
+		a.rpcWarn(fmt.Sprintf("%s: %v", onion, err))
+		return nil, err
+	}
+
+	var solution string
+	if len(vals) > 3 {
+		solution = vals[3]
+	}
+	p, err := a.provePending(onion, ps, sig, solution)
+	if err != nil {
+		return nil, err
 	}
 
-	rpcInfo(fmt.Sprintf("validation success for %s", onion))
+	// A signature can only ever validate once.
+	if err := a.pendingAnn.claim(onion, p); err != nil {
+		a.rpcWarn(fmt.Sprintf("%s: %v", onion, err))
+		return nil, err
+	}
 
-	var ret []string
-	for addr, data := range Peers {
-		if data.Trusted > 0 {
-			ret = append(ret, addr)
+	if rec != nil && !rec.Pubkey.Equal(p.Pubkey) {
+		a.rpcWarn(fmt.Sprintf("%s sent a record with a foreign key", onion))
+		return nil, errors.New("peer record doesn't match public key")
+	}
+
+	// The ACL might have changed since the handshake was started.
+	if !a.Access.Permitted(onion, p.Pubkey) {
+		a.rpcWarn(fmt.Sprintf("%s is blocked", onion))
+		return nil, errors.New("access denied")
+	}
+
+	// If another handshake for the same onion completed in the meantime,
+	// the revoke key this one was started with is no longer valid.
+	var verr error
+	var trust int
+	a.Peers.Update(onion, func(peer Peer, ok bool) (Peer, bool) {
+		revoke := peer.PeerRevoke
+		if revoke == "" {
+			k, _ := a.Revokes.Get(onion)
+			revoke = k.Peer
+		}
+		if revoke != p.PrevRevoke {
+			verr = errors.New("handshake was superseded")
+			return peer, false
+		}
+
+		peer.Pubkey = p.Pubkey
+		peer.Portmap = p.Portmap
+		peer.PeerRevoke = p.Revoke
+		// A record signed with another key than the one just proven was
+		// relayed by somebody else, and must not outlive the handshake.
+		if peer.Record != nil && !peer.Record.Pubkey.Equal(p.Pubkey) {
+			peer.Record = nil
+		}
+		if rec != nil && (peer.Record == nil || rec.Seq > peer.Record.Seq) {
+			peer.Record = rec
 		}
+		peer.Trusted = promote(peer.Trusted, TrustValidated)
+		peer.LastSeen = time.Now().Unix()
+		peer.Left = nil
+		trust = peer.Trusted
+		return peer, true
+	})
+	if verr != nil {
+		a.rpcWarn(fmt.Sprintf("%s: %v", onion, verr))
+		return nil, verr
 	}
 
-	peer.Nonce = ""
-	peer.Trusted = 1
-	peer.LastSeen = time.Now().Unix()
-	Peers[onion] = peer
+	if err := a.Revokes.SetPeer(onion, p.Revoke); err != nil {
+		a.rpcInternalErr(err.Error())
+	}
+
+	a.rpcInfo(fmt.Sprintf("validation success for %s", onion))
+
+	fresh := time.Now().Add(-a.Cfg.peerFreshness()).Unix()
+
+	candidates := make(map[string]Peer)
+	a.Peers.Range(func(addr string, data Peer) bool {
+		if a.shareable(addr, data, onion, fresh) {
+			candidates[addr] = data
+		}
+		return true
+	})
 
-	rpcInfo(fmt.Sprintf("sending back list of peers to %s", onion))
+	var ret []string
+	for _, addr := range a.Cfg.sharePolicy(trust).Select(candidates) {
+		if entry := shareEntry(addr, candidates[addr], rec != nil); entry != "" {
+			ret = append(ret, entry)
+		}
+	}
+
+	a.rpcInfo(fmt.Sprintf("sending back list of peers to %s", onion))
 	return ret, nil
 }
+
+// provePending returns the pending handshake of the given onion proven by
+// the given signature and proof of work.
+func (a Ann) provePending(onion string, ps []pending, sig []byte, solution string) (pending, error) {
+	var worked bool
+	for _, p := range ps {
+		if !checkPow(a.Onion, onion, p.Nonce, solution, p.Difficulty) {
+			continue
+		}
+		worked = true
+
+		chal := Challenge{
+			Responder: a.Onion,
+			Announcer: onion,
+			Nonce:     p.Nonce,
+			Portmap:   p.Portmap,
+			Timestamp: p.Timestamp,
+		}
+		if ed25519.Verify(p.Pubkey, chal.Bytes(), sig) {
+			return p, nil
+		}
+		if a.Cfg.LegacyChallenge && ed25519.Verify(p.Pubkey, []byte(p.Nonce), sig) {
+			a.rpcWarn(fmt.Sprintf("%s validated with a legacy signature", onion))
+			return p, nil
+		}
+	}
+
+	if !worked {
+		a.rpcWarn(fmt.Sprintf("%s sent an insufficient proof of work", onion))
+		return pending{}, errors.New("insufficient proof of work")
+	}
+	a.rpcWarn("signature verification failed")
+	return pending{}, errors.New("signature verification failed")
+}
+
+// shareable reports whether the given peer may be handed out to the given
+// caller. Stale peers are not handed out, even before they get reaped, and
+// neither are peers not trusted enough or blocked by the Access list.
+// Tombstones vouch for themselves, so they are shared regardless of trust.
+func (n *Node) shareable(addr string, data Peer, caller string, fresh int64) bool {
+	if addr == caller || !n.Access.Permitted(addr, data.key()) {
+		return false
+	}
+	if data.Left != nil {
+		return data.Left.Timestamp >= fresh
+	}
+	return data.Trusted >= n.Cfg.shareTrust() && data.LastSeen >= fresh
+}
+
+// shareEntry returns the peer list entry of the given peer. Peers knowing
+// about records get the peer's record or tombstone, where we know one, and
+// other peers get the bare onion address, or nothing for a tombstone.
+func shareEntry(addr string, data Peer, records bool) string {
+	switch {
+	case data.Left != nil && records:
+		return data.Left.String()
+	case data.Left != nil:
+		return ""
+	case data.Record != nil && records:
+		return data.Record.String()
+	}
+	return addr
+}
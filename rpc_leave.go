@@ -0,0 +1,112 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+// Leave takes two or three parameters:
+// - onion: onionaddress:port of the peer leaving the network
+// - revoke: the revocation key we issued to the peer, may be empty if a
+//   tombstone is given
+// - tombstone: (optional) the peer's Tombstone, as in peer lists
+//  {
+//   "jsonrpc":"2.0",
+//   "id":1,
+//   "method": "ann.Leave",
+//   "params": ["unlikelynameforan.onion:49371", "somerevokekey", "-{...}"]
+//  }
+// Returns:
+// - An empty list
+//  {
+//   "jsonrpc":"2.0",
+//   "id":1,
+//   "result": []
+//  }
+// A leave authenticated only by the revoke key removes the peer from our
+// store. A tombstone, signed by the key we know for the peer, or by its
+// onion key with Cfg.BindOnionKey, is kept in its place instead, and handed
+// out to other peers like a PeerRecord, so the departure spreads across
+// the network.
+// On any kind of failure returns an error and the reason.
+func (a Ann) Leave(ctx context.Context, vals []string) ([]string, error) {
+	if len(vals) < 2 || len(vals) > 3 {
+		return nil, errors.New("invalid parameters")
+	}
+
+	onion := vals[0]
+	revoke := vals[1]
+
+	if err := ValidateOnionInternal(onion); err != nil {
+		a.rpcWarn(err.Error())
+		return nil, err
+	}
+
+	a.rpcInfo(fmt.Sprintf("got request for %s", onion))
+
+	if err := a.rateLimit(onion, nil); err != nil {
+		return nil, err
+	}
+
+	var tomb *Tombstone
+	if len(vals) == 3 && vals[2] != "" {
+		t, err := a.parseTombstone(vals[2])
+		if err != nil {
+			a.rpcWarn(fmt.Sprintf("%s: %v", onion, err))
+			return nil, err
+		}
+		if t.Onion != onion {
+			a.rpcWarn(fmt.Sprintf("%s sent a tombstone of %s", onion, t.Onion))
+			return nil, errors.New("tombstone doesn't match onion address")
+		}
+		tomb = &t
+	}
+
+	if tomb != nil {
+		peer, _ := a.Peers.Get(onion)
+		key := peer.key()
+		if key == nil && !a.Cfg.BindOnionKey {
+			a.rpcWarn(fmt.Sprintf("%s sent a tombstone of an unknown key", onion))
+			return nil, errors.New("this onion has no known public key")
+		}
+		if key != nil && !key.Equal(tomb.Pubkey) {
+			a.rpcWarn(fmt.Sprintf("%s sent a tombstone with a foreign key", onion))
+			return nil, errors.New("tombstone doesn't match public key")
+		}
+		a.bury(*tomb)
+		return []string{}, nil
+	}
+
+	known, _ := a.peerRevoke(onion)
+	if known == "" || subtle.ConstantTimeCompare([]byte(known), []byte(revoke)) != 1 {
+		a.rpcWarn(fmt.Sprintf("%s: revocation key doesn't match", onion))
+		return nil, errors.New("revocation key doesn't match")
+	}
+
+	a.Peers.Delete(onion)
+	if err := a.Revokes.Delete(onion); err != nil {
+		a.rpcInternalErr(err.Error())
+	}
+	a.rpcInfo(fmt.Sprintf("%s left the network", onion))
+
+	return []string{}, nil
+}
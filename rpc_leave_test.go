@@ -0,0 +1,363 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestTombstone(t *testing.T) {
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, fsk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+
+	tomb := NewTombstone(sk, onion)
+	if !isTombstone(tomb.String()) || isRecord(tomb.String()) {
+		t.Fatal("tombstone not recognized as one")
+	}
+	parsed, err := ParseTombstone(tomb.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Onion != onion || parsed.Timestamp != tomb.Timestamp {
+		t.Fatalf("tombstone did not survive encoding: %v", parsed)
+	}
+
+	tampered := tomb
+	tampered.Timestamp++
+	if _, err := ParseTombstone(tampered.String()); err == nil {
+		t.Fatal("tampered tombstone was parsed")
+	}
+	if _, err := ParseTombstone(NewRecord(sk, onion, nil).String()); err == nil {
+		t.Fatal("record was parsed as a tombstone")
+	}
+
+	n := newTestNode(t)
+	n.Cfg.BindOnionKey = true
+	if _, err := n.parseTombstone(NewTombstone(fsk, onion).String()); err == nil {
+		t.Fatal("tombstone with a foreign key verified with Cfg.BindOnionKey")
+	}
+	if _, err := n.parseTombstone(tomb.String()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeave(t *testing.T) {
+	n := newTestNode(t)
+	n.Cfg.RateLimit = -1
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, fsk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+
+	announce := func(revoke string) string {
+		ret, err := n.Ann().Init(context.Background(), []string{onion,
+			base64.StdEncoding.EncodeToString(pk), "12345:54321", revoke})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := n.Ann().Validate(context.Background(), []string{
+			onion, testSign(n, sk, onion, []string{"12345:54321"}, ret)}); err != nil {
+			t.Fatal(err)
+		}
+		return ret[1]
+	}
+	leave := func(vals ...string) error {
+		_, err := n.Ann().Leave(context.Background(), append([]string{onion}, vals...))
+		return err
+	}
+
+	// Leaving with the revoke key removes the peer.
+	revoke := announce("")
+	if err := leave("foo"); err == nil {
+		t.Fatal("left with a wrong revoke key")
+	}
+	if err := leave(revoke); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := n.Peers.Get(onion); ok {
+		t.Fatal("peer still known after leaving")
+	}
+	if k, _ := n.Revokes.Get(onion); k.Peer != "" {
+		t.Fatal("revoke key still known after leaving")
+	}
+
+	// Leaving with a tombstone keeps it around to be shared.
+	announce("")
+	if err := leave("", NewTombstone(fsk, onion).String()); err == nil {
+		t.Fatal("left with a tombstone of a foreign key")
+	}
+	tomb := NewTombstone(sk, onion)
+	if err := leave("", tomb.String()); err != nil {
+		t.Fatal(err)
+	}
+	p, ok := n.Peers.Get(onion)
+	if !ok || p.Left == nil || p.Pubkey != nil || p.PeerRevoke != "" {
+		t.Fatalf("got %v after leaving with a tombstone", p)
+	}
+
+	opk, osk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := testOnion(opk, 666)
+	validate := func(extra ...string) []string {
+		// Start afresh, so no revoke key is needed.
+		n.Revokes.Delete(other)
+		n.Peers.Delete(other)
+		ret, err := n.Ann().Init(context.Background(), []string{other,
+			base64.StdEncoding.EncodeToString(opk), "1:1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers, err := n.Ann().Validate(context.Background(), append([]string{
+			other, testSign(n, osk, other, []string{"1:1"}, ret)}, extra...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return peers
+	}
+	if peers := validate(); len(peers) != 0 {
+		t.Fatalf("got %v for a peer not knowing tombstones", peers)
+	}
+	peers := validate(NewRecord(osk, other, []string{"1:1"}).String())
+	if len(peers) != 1 || peers[0] != tomb.String() {
+		t.Fatalf("got %v, expected the tombstone", peers)
+	}
+
+	// The peer can come back.
+	announce("")
+	if p, _ := n.Peers.Get(onion); p.Left != nil {
+		t.Fatal("tombstone kept after coming back")
+	}
+}
+
+func TestAppendTombstones(t *testing.T) {
+	n := newTestNode(t)
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, fsk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+
+	old := NewRecord(sk, onion, nil)
+	old.Timestamp -= 10
+	old.Signature = ed25519.Sign(sk, old.Bytes())
+	if err := n.AppendPeers([]string{old.String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := n.AppendPeers([]string{NewTombstone(fsk, onion).String()}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(onion); p.Left != nil {
+		t.Fatal("tombstone of a foreign key was applied")
+	}
+
+	tomb := NewTombstone(sk, onion)
+	if err := n.AppendPeers([]string{tomb.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(onion); p.Left == nil || p.Record != nil {
+		t.Fatal("tombstone was not applied")
+	}
+
+	// Records from before the departure don't bring the peer back, but
+	// newer ones do.
+	stale := NewRecord(sk, onion, nil)
+	stale.Timestamp = tomb.Timestamp
+	stale.Signature = ed25519.Sign(sk, stale.Bytes())
+	if err := n.AppendPeers([]string{stale.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(onion); p.Left == nil {
+		t.Fatal("stale record brought the peer back")
+	}
+
+	fresh := NewRecord(sk, onion, nil)
+	fresh.Timestamp = time.Now().Add(time.Second).Unix()
+	fresh.Signature = ed25519.Sign(sk, fresh.Bytes())
+	if err := n.AppendPeers([]string{fresh.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(onion); p.Left != nil || p.Record == nil {
+		t.Fatal("newer record did not bring the peer back")
+	}
+}
+
+func TestAppendTombstonesUnknown(t *testing.T) {
+	n := newTestNode(t)
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+
+	// Anyone can sign a tombstone of a peer whose key we don't know.
+	tomb := NewTombstone(sk, onion)
+	if err := n.AppendPeers([]string{tomb.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := n.Peers.Get(onion); ok {
+		t.Fatal("tombstone of an unknown key was applied")
+	}
+	if _, err := n.Ann().Leave(context.Background(),
+		[]string{onion, "", tomb.String()}); err == nil {
+		t.Fatal("left with a tombstone of an unknown key")
+	}
+
+	// Unless the onion itself proves the key.
+	n.Cfg.BindOnionKey = true
+	if err := n.AppendPeers([]string{tomb.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(onion); p.Left == nil {
+		t.Fatal("tombstone of the onion key was not applied")
+	}
+}
+
+func TestAppendFutureDated(t *testing.T) {
+	n := newTestNode(t)
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+	future := time.Now().Add(maxClockSkew + time.Hour).Unix()
+
+	rec := NewRecord(sk, onion, nil)
+	rec.Timestamp = future
+	rec.Signature = ed25519.Sign(sk, rec.Bytes())
+	if err := n.AppendPeers([]string{rec.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := n.Peers.Get(onion); ok {
+		t.Fatal("future dated record was appended")
+	}
+
+	if err := n.AppendPeers([]string{NewRecord(sk, onion, nil).String()}); err != nil {
+		t.Fatal(err)
+	}
+	tomb := NewTombstone(sk, onion)
+	tomb.Timestamp = future
+	tomb.Signature = ed25519.Sign(sk, tomb.Bytes())
+	if err := n.AppendPeers([]string{tomb.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(onion); p.Left != nil {
+		t.Fatal("future dated tombstone was applied")
+	}
+	if _, err := n.Ann().Leave(context.Background(),
+		[]string{onion, "", tomb.String()}); err == nil {
+		t.Fatal("left with a future dated tombstone")
+	}
+
+	// Clocks a little ahead are tolerated.
+	tomb.Timestamp = time.Now().Add(time.Minute).Unix()
+	tomb.Signature = ed25519.Sign(sk, tomb.Bytes())
+	if err := n.AppendPeers([]string{tomb.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(onion); p.Left == nil {
+		t.Fatal("tombstone within the clock skew was not applied")
+	}
+}
+
+func TestLeaveAnnounce(t *testing.T) {
+	srv := newTestNode(t)
+	n := newTestNode(t)
+	n.Cfg.TorAddr = startTestServer(t, srv)
+
+	if err := n.Announce(context.Background(), srv.Onion); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Leave(context.Background(), srv.Onion); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := srv.Peers.Get(n.Onion); p.Left == nil || p.Pubkey != nil {
+		t.Fatalf("got %v after leaving", p)
+	}
+	if p, _ := n.Peers.Get(srv.Onion); p.SelfRevoke != "" {
+		t.Fatal("revoke key of the left peer kept")
+	}
+}
+
+func TestLeaveReplay(t *testing.T) {
+	srv := newTestNode(t)
+	n := newTestNode(t)
+	n.Cfg.TorAddr = startTestServer(t, srv)
+
+	if err := n.Announce(context.Background(), srv.Onion); err != nil {
+		t.Fatal(err)
+	}
+
+	// The peer left after our last handshake with it.
+	tomb := NewTombstone(srv.SignKey, srv.Onion)
+	tomb.Timestamp = time.Now().Add(-time.Minute).Unix()
+	tomb.Signature = ed25519.Sign(srv.SignKey, tomb.Bytes())
+	n.Peers.Update(srv.Onion, func(p Peer, ok bool) (Peer, bool) {
+		p.LastSeen = tomb.Timestamp - 60
+		return p, ok
+	})
+	if err := n.AppendPeers([]string{tomb.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(srv.Onion); p.Left == nil {
+		t.Fatal("tombstone was not applied")
+	}
+
+	// It came back, and its old tombstone gets replayed.
+	if err := n.Announce(context.Background(), srv.Onion); err != nil {
+		t.Fatal(err)
+	}
+	revoke, _ := n.selfRevoke(srv.Onion)
+	if err := n.AppendPeers([]string{tomb.String()}); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := n.Peers.Get(srv.Onion)
+	if p.Left != nil || p.Pubkey == nil || p.Trusted != TrustValidated {
+		t.Fatalf("got %v after a replayed tombstone", p)
+	}
+	if k, _ := n.Revokes.Get(srv.Onion); k.Self != revoke || revoke == "" {
+		t.Fatal("revoke key dropped by a replayed tombstone")
+	}
+}
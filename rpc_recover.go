@@ -0,0 +1,196 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// recoverMessage returns the message to be signed in order to prove
+// possession of a peer's key during revocation key recovery. It is
+// prefixed so that it can never be mistaken for an announce signature.
+func recoverMessage(onion, challenge string) []byte {
+	return []byte("tordam-recover\n" + onion + "\n" + challenge)
+}
+
+// Recover takes two parameters:
+// - onion: onionaddress:port of a peer that lost its revocation key
+// - pubkey: the ed25519 public key in base64 the peer announced with
+//  {
+//   "jsonrpc":"2.0",
+//   "id": 1,
+//   "method": "ann.Recover",
+//   "params": ["unlikelynameforan.onion:49371", "214="]
+//  }
+// Returns:
+// - challenge: A random challenge which is to be signed by the client
+//  {
+//   "jsonrpc":"2.0",
+//   "id":1,
+//   "result": ["somechallenge"]
+//  }
+// The public key must be the one we already know for this peer, as only
+// its owner can complete the recovery with Reclaim.
+// On any kind of failure returns an error and the reason.
+func (a Ann) Recover(ctx context.Context, vals []string) ([]string, error) {
+	if len(vals) != 2 {
+		return nil, errors.New("invalid parameters")
+	}
+
+	onion := vals[0]
+	pubkey := vals[1]
+
+	if err := ValidateOnionInternal(onion); err != nil {
+		a.rpcWarn(err.Error())
+		return nil, err
+	}
+
+	a.rpcInfo(fmt.Sprintf("got request for %s", onion))
+
+	pk, err := base64.StdEncoding.DecodeString(pubkey)
+	if err != nil {
+		a.rpcWarn("got invalid base64 public key")
+		return nil, errors.New("invalid base64 public key")
+	}
+
+	if err := a.rateLimit(onion, pk); err != nil {
+		return nil, err
+	}
+
+	peer, ok := a.Peers.Get(onion)
+	if !ok || peer.Pubkey == nil {
+		a.rpcWarn(fmt.Sprintf("%s has no known public key", onion))
+		return nil, errors.New("this onion has no known public key")
+	}
+	if !bytes.Equal(pk, peer.Pubkey) {
+		a.rpcWarn(fmt.Sprintf("%s tried to recover with a different key", onion))
+		return nil, errors.New("public key doesn't match")
+	}
+	if !a.Access.Permitted(onion, peer.Pubkey) {
+		a.rpcWarn(fmt.Sprintf("%s is blocked", onion))
+		return nil, errors.New("access denied")
+	}
+
+	challenge, err := RandomGarbage(32)
+	if err != nil {
+		a.rpcInternalErr(err.Error())
+		return nil, errors.New("internal error")
+	}
+
+	// The challenge handed out last stays valid until it expires, so that
+	// nobody else knowing the key can replace it under its owner.
+	rc, err := a.pendingRecover.reuse(onion, pending{Pubkey: pk, Nonce: challenge})
+	if err != nil {
+		a.rpcWarn(err.Error())
+		return nil, err
+	}
+
+	return []string{rc.Nonce}, nil
+}
+
+// Reclaim takes two parameters:
+// - onion: onionaddress:port of the peer
+// - signature: base64 signature of the challenge obtained with Recover
+//  {
+//   "jsonrpc":"2.0",
+//   "id":2,
+//   "method": "ann.Reclaim",
+//   "params": ["unlikelynameforan.onion:49371", "deadbeef=="]
+//  }
+// Returns:
+// - revoke: A new revocation key, replacing the lost one
+//  {
+//   "jsonrpc":"2.0",
+//   "id":2,
+//   "result": ["somerevokekey"]
+//  }
+// On any kind of failure returns an error and the reason.
+func (a Ann) Reclaim(ctx context.Context, vals []string) ([]string, error) {
+	if len(vals) != 2 {
+		return nil, errors.New("invalid parameters")
+	}
+
+	onion := vals[0]
+	signature := vals[1]
+
+	if err := ValidateOnionInternal(onion); err != nil {
+		a.rpcWarn(err.Error())
+		return nil, err
+	}
+
+	a.rpcInfo(fmt.Sprintf("got request for %s", onion))
+
+	if err := a.rateLimit(onion, nil); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		a.rpcWarn("invalid base64 signature string")
+		return nil, errors.New("invalid base64 signature string")
+	}
+
+	// Challenges are handed out for the key we know for the peer.
+	known, _ := a.Peers.Get(onion)
+	rc, err := a.pendingRecover.get(onion, known.Pubkey)
+	if err != nil {
+		a.rpcWarn(fmt.Sprintf("%s: %v", onion, err))
+		return nil, err
+	}
+
+	newrevoke, err := RandomGarbage(128)
+	if err != nil {
+		a.rpcInternalErr(err.Error())
+		return nil, errors.New("internal error")
+	}
+
+	var verr error
+	a.Peers.Update(onion, func(peer Peer, ok bool) (Peer, bool) {
+		if !ok || peer.Pubkey == nil {
+			verr = errors.New("this onion has no known public key")
+			return peer, false
+		}
+		if !peer.Pubkey.Equal(rc.Pubkey) ||
+			!ed25519.Verify(peer.Pubkey, recoverMessage(onion, rc.Nonce), sig) {
+			verr = errors.New("signature verification failed")
+			return peer, false
+		}
+		// A challenge can only ever be used once.
+		if verr = a.pendingRecover.claim(onion, rc); verr != nil {
+			return peer, false
+		}
+		peer.PeerRevoke = newrevoke
+		return peer, true
+	})
+	if verr != nil {
+		a.rpcWarn(verr.Error())
+		return nil, verr
+	}
+
+	if err := a.Revokes.SetPeer(onion, newrevoke); err != nil {
+		a.rpcInternalErr(err.Error())
+	}
+
+	a.rpcInfo(fmt.Sprintf("issued new revocation key to %s", onion))
+	return []string{newrevoke}, nil
+}
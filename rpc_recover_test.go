@@ -0,0 +1,96 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+)
+
+func TestRecover(t *testing.T) {
+	srv := newTestNode(t)
+	n := newTestNode(t)
+	n.Cfg.TorAddr = startTestServer(t, srv)
+	pk, sk := testKey(n), n.SignKey
+
+	if err := n.Announce(context.Background(), srv.Onion); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lose our revoke key, while the remote still knows the one it issued.
+	lose := func() {
+		n.Peers.Update(srv.Onion, func(p Peer, ok bool) (Peer, bool) {
+			p.SelfRevoke = ""
+			return p, ok
+		})
+		n.Revokes.SetSelf(srv.Onion, "")
+	}
+	lose()
+	if err := n.Announce(context.Background(), srv.Onion); err != nil {
+		t.Fatalf("announce with recovery failed: %v", err)
+	}
+
+	// Someone with a different key must not be able to recover.
+	lose()
+	_, fsk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.SignKey = fsk
+	if err := n.Announce(context.Background(), srv.Onion); err == nil {
+		t.Fatal("recovery with a different key succeeded")
+	}
+
+	// A signature over anything but a fresh challenge must be refused.
+	srv.Cfg.RateLimit = -1
+	ret, err := srv.Ann().Recover(context.Background(), []string{
+		n.Onion, base64.StdEncoding.EncodeToString(pk)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reclaim := func(sig []byte) error {
+		_, err := srv.Ann().Reclaim(context.Background(), []string{
+			n.Onion, base64.StdEncoding.EncodeToString(sig)})
+		return err
+	}
+	if err := reclaim(ed25519.Sign(sk, []byte(ret[0]))); err == nil {
+		t.Fatal("reclaim with a bare challenge signature succeeded")
+	}
+
+	// Anyone knowing our key gets the same challenge, instead of replacing
+	// it under us.
+	again, err := srv.Ann().Recover(context.Background(), []string{
+		n.Onion, base64.StdEncoding.EncodeToString(pk)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again[0] != ret[0] {
+		t.Fatal("pending challenge was replaced")
+	}
+
+	sig := ed25519.Sign(sk, recoverMessage(n.Onion, ret[0]))
+	if err := reclaim(sig); err != nil {
+		t.Fatal(err)
+	}
+	if err := reclaim(sig); err == nil {
+		t.Fatal("reclaim with a consumed challenge succeeded")
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Rotate takes two parameters:
+// - onion: onionaddress:port of the peer rotating its key
+// - rotation: the peer's Rotation, JSON encoded
+//  {
+//   "jsonrpc":"2.0",
+//   "id":1,
+//   "method": "ann.Rotate",
+//   "params": ["unlikelynameforan.onion:49371", "{...}"]
+//  }
+// Returns:
+// - An empty list
+//  {
+//   "jsonrpc":"2.0",
+//   "id":1,
+//   "result": []
+//  }
+// The old key of the rotation must be the one we know for the peer, which
+// is then replaced by the new key. The peer's record, signed by the old
+// key, is dropped until the peer publishes a new one. Rotations not newer
+// than the last one we accepted are refused, so a peer rotating back to an
+// old key can't have it replaced by a replayed rotation.
+// On any kind of failure returns an error and the reason.
+func (a Ann) Rotate(ctx context.Context, vals []string) ([]string, error) {
+	if len(vals) != 2 {
+		return nil, errors.New("invalid parameters")
+	}
+
+	onion := vals[0]
+
+	if err := ValidateOnionInternal(onion); err != nil {
+		a.rpcWarn(err.Error())
+		return nil, err
+	}
+
+	a.rpcInfo(fmt.Sprintf("got request for %s", onion))
+
+	if err := a.rateLimit(onion, nil); err != nil {
+		return nil, err
+	}
+
+	r, err := ParseRotation(vals[1])
+	if err != nil {
+		a.rpcWarn(fmt.Sprintf("%s: %v", onion, err))
+		return nil, err
+	}
+	// Keys bound to onion addresses can't be rotated, as the onion
+	// address would change along with the key.
+	if a.Cfg.BindOnionKey {
+		a.rpcWarn(fmt.Sprintf("%s tried to rotate a bound key", onion))
+		return nil, errors.New("keys bound to onion addresses can't be rotated")
+	}
+	if r.Onion != onion {
+		a.rpcWarn(fmt.Sprintf("%s sent a rotation of %s", onion, r.Onion))
+		return nil, errors.New("rotation doesn't match onion address")
+	}
+
+	if !a.Access.Permitted(onion, r.NewKey) {
+		a.rpcWarn(fmt.Sprintf("%s rotated to a blocked key", onion))
+		return nil, errors.New("access denied")
+	}
+
+	var rerr error
+	a.Peers.Update(onion, func(peer Peer, ok bool) (Peer, bool) {
+		if !ok || peer.Pubkey == nil {
+			rerr = errors.New("this onion has no known public key")
+			return peer, false
+		}
+		if r.Timestamp == peer.Rotated && peer.Pubkey.Equal(r.NewKey) {
+			rerr = errors.New("rotation was already applied")
+			return peer, false
+		}
+		if r.Timestamp <= peer.Rotated {
+			rerr = errors.New("rotation is older than the last one")
+			return peer, false
+		}
+		if !peer.Pubkey.Equal(r.OldKey) {
+			rerr = errors.New("public key doesn't match")
+			return peer, false
+		}
+		peer.Pubkey = r.NewKey
+		peer.Record = nil
+		peer.Rotated = r.Timestamp
+		return peer, true
+	})
+	if rerr != nil {
+		a.rpcWarn(fmt.Sprintf("%s: %v", onion, rerr))
+		return nil, rerr
+	}
+
+	a.rpcInfo(fmt.Sprintf("%s rotated its key", onion))
+	return []string{}, nil
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+)
+
+func TestRotation(t *testing.T) {
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, nsk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+
+	rot := NewRotation(sk, nsk, onion)
+	if _, err := ParseRotation(rot.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both keys have to sign.
+	forged := rot
+	forged.NewSig = forged.OldSig
+	if err := forged.Verify(); err == nil {
+		t.Fatal("rotation without the new key's signature verified")
+	}
+	forged = rot
+	forged.Timestamp++
+	if err := forged.Verify(); err == nil {
+		t.Fatal("tampered rotation verified")
+	}
+	if err := NewRotation(sk, sk, onion).Verify(); err == nil {
+		t.Fatal("rotation to the same key verified")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	n := newTestNode(t)
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	npk, nsk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, fsk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+
+	rotate := func(r Rotation) error {
+		_, err := n.Ann().Rotate(context.Background(), []string{onion, r.String()})
+		return err
+	}
+
+	if err := rotate(NewRotation(sk, nsk, onion)); err == nil {
+		t.Fatal("rotated the key of an unknown peer")
+	}
+
+	ret, err := n.Ann().Init(context.Background(), []string{
+		onion, base64.StdEncoding.EncodeToString(pk), "12345:54321"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Ann().Validate(context.Background(), []string{
+		onion, testSign(n, sk, onion, []string{"12345:54321"}, ret),
+		NewRecord(sk, onion, []string{"12345:54321"}).String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rotate(NewRotation(fsk, nsk, onion)); err == nil {
+		t.Fatal("rotated from a key other than known")
+	}
+	if err := rotate(NewRotation(sk, nsk, testOnion(pk, 1))); err == nil {
+		t.Fatal("rotated the key of another onion")
+	}
+
+	old := NewRotation(sk, nsk, onion)
+	n.Cfg.BindOnionKey = true
+	if err := rotate(old); err == nil {
+		t.Fatal("rotated with Cfg.BindOnionKey")
+	}
+	n.Cfg.BindOnionKey = false
+	if err := rotate(old); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := n.Peers.Get(onion)
+	if !p.Pubkey.Equal(npk) || p.Record != nil {
+		t.Fatalf("got %v after rotating", p)
+	}
+
+	// The new key is the one to recover with, and the rotation can't be
+	// replayed.
+	if _, err := n.Ann().Recover(context.Background(), []string{
+		onion, base64.StdEncoding.EncodeToString(npk)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rotate(old); err == nil {
+		t.Fatal("rotation was replayed")
+	}
+
+	// Neither after rotating back to the old key.
+	back := NewRotation(nsk, sk, onion)
+	back.Timestamp = old.Timestamp + 1
+	back.OldSig = ed25519.Sign(nsk, back.Bytes())
+	back.NewSig = ed25519.Sign(sk, back.Bytes())
+	if err := rotate(back); err != nil {
+		t.Fatal(err)
+	}
+	if err := rotate(old); err == nil {
+		t.Fatal("rotation was replayed after rotating back")
+	}
+	if p, _ := n.Peers.Get(onion); !p.Pubkey.Equal(pk) {
+		t.Fatal("replayed rotation was applied")
+	}
+}
+
+func TestRotateAnnounce(t *testing.T) {
+	srv := newTestNode(t)
+	n := newTestNode(t)
+	n.Cfg.TorAddr = startTestServer(t, srv)
+
+	npk, nsk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := n.Announce(context.Background(), srv.Onion); err != nil {
+		t.Fatal(err)
+	}
+	rot := NewRotation(n.SignKey, nsk, n.Onion)
+	if err := n.Rotate(context.Background(), srv.Onion, rot); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := srv.Peers.Get(n.Onion); !p.Pubkey.Equal(npk) {
+		t.Fatal("rotation was not applied")
+	}
+
+	// Pushing it again, as when some peers missed it, succeeds.
+	if err := n.Rotate(context.Background(), srv.Onion, rot); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rotated key is used from now on.
+	n.SignKey = nsk
+	if err := n.Announce(context.Background(), srv.Onion); err != nil {
+		t.Fatal(err)
+	}
+}
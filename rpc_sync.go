@@ -0,0 +1,218 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SyncResult is the result of ann.Sync.
+type SyncResult struct {
+	Cursor  string   `json:"cursor"`  // Cursor to pass to the next Sync call
+	More    bool     `json:"more"`    // Whether more changes follow Cursor
+	Reset   bool     `json:"reset"`   // Whether Peers is a full view, not changes
+	Peers   []string `json:"peers"`   // Added, changed or left peers, as in Validate
+	Removed []string `json:"removed"` // Onion addresses of peers no longer shared
+}
+
+// resetMark marks the ann.Sync cursors handed out in the middle of a full
+// view of the peers.
+const resetMark = "reset"
+
+// formatCursor returns the ann.Sync cursor for the given generation of the
+// node's Peers store, marked as the middle of a full view if reset is set.
+func (n *Node) formatCursor(gen uint64, reset bool) string {
+	if reset {
+		return fmt.Sprintf("%d.%d.%s", n.Peers.Epoch(), gen, resetMark)
+	}
+	return fmt.Sprintf("%d.%d", n.Peers.Epoch(), gen)
+}
+
+// parseCursor returns the generation of the node's Peers store the given
+// ann.Sync cursor points to, and whether it is in the middle of a full
+// view. It returns false if the cursor is empty or refers to another epoch
+// of the store, such as before a restart.
+func (n *Node) parseCursor(cursor string) (uint64, bool, bool, error) {
+	if cursor == "" {
+		return 0, false, false, nil
+	}
+
+	parts := strings.Split(cursor, ".")
+	if len(parts) != 2 && (len(parts) != 3 || parts[2] != resetMark) {
+		return 0, false, false, errors.New("invalid cursor")
+	}
+	epoch, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, false, false, errors.New("invalid cursor")
+	}
+	gen, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, false, false, errors.New("invalid cursor")
+	}
+
+	if epoch != n.Peers.Epoch() {
+		return 0, false, false, nil
+	}
+	return gen, true, len(parts) == 3, nil
+}
+
+// Sync takes three or four parameters:
+// - onion: onionaddress:port of the calling peer
+// - revoke: the revocation key we issued to the peer when it announced
+// - cursor: the cursor returned by the previous Sync call, or "" initially
+// - limit: (optional) the maximum number of peers to return
+//  {
+//   "jsonrpc":"2.0",
+//   "id":1,
+//   "method": "ann.Sync",
+//   "params": ["unlikelynameforan.onion:49371", "somerevokekey", "", "100"]
+//  }
+// Returns:
+// - A SyncResult with the peers added, changed or no longer shared since
+//   the cursor, in order of modification. A page holds at most
+//   Cfg.SyncLimit peers and Cfg.SyncMaxBytes of peers. If the cursor is
+//   empty or no longer valid, a full view of the shared peers is returned,
+//   with reset set. Peers are only reported as no longer shared if they
+//   were shared as of the cursor, and are not blocked by the Access list.
+//   Peers going stale are not reported, as they are not modified, and are
+//   left for the caller to reap. Sync is only permitted to peers whose
+//   SharePolicy is ShareAll.
+//  {
+//   "jsonrpc":"2.0",
+//   "id":1,
+//   "result": {
+//    "cursor": "1612345678901234567.42",
+//    "more": false,
+//    "reset": false,
+//    "peers": ["{\"onion\":...}", "yetanother.onion:420"],
+//    "removed": ["unlikelynameforan.onion:69"]
+//   }
+//  }
+// On any kind of failure returns an error and the reason.
+func (a Ann) Sync(ctx context.Context, vals []string) (SyncResult, error) {
+	var res SyncResult
+
+	if len(vals) < 3 || len(vals) > 4 {
+		return res, errors.New("invalid parameters")
+	}
+
+	onion := vals[0]
+	revoke := vals[1]
+
+	if err := ValidateOnionInternal(onion); err != nil {
+		a.rpcWarn(err.Error())
+		return res, err
+	}
+
+	a.rpcInfo(fmt.Sprintf("got request for %s", onion))
+
+	if err := a.rateLimit(onion, nil); err != nil {
+		return res, err
+	}
+
+	// Only peers which completed a handshake with us hold a revoke key.
+	known, _ := a.peerRevoke(onion)
+	if known == "" || subtle.ConstantTimeCompare([]byte(known), []byte(revoke)) != 1 {
+		a.rpcWarn(fmt.Sprintf("%s: revocation key doesn't match", onion))
+		return res, errors.New("revocation key doesn't match")
+	}
+
+	peer, _ := a.Peers.Get(onion)
+	if !a.Access.Permitted(onion, peer.key()) {
+		a.rpcWarn(fmt.Sprintf("%s is blocked", onion))
+		return res, errors.New("access denied")
+	}
+
+	// A sync discloses every shareable peer over time, so it is only
+	// offered to peers we share everything with anyway.
+	if _, all := a.Cfg.sharePolicy(peer.Trusted).(ShareAll); !all {
+		a.rpcWarn(fmt.Sprintf("%s: sync not permitted by share policy", onion))
+		return res, errors.New("sync not permitted")
+	}
+
+	since, valid, partial, err := a.parseCursor(vals[2])
+	if err != nil {
+		a.rpcWarn(fmt.Sprintf("%s: %v", onion, err))
+		return res, err
+	}
+
+	limit := a.Cfg.syncLimit()
+	if len(vals) == 4 && vals[3] != "" {
+		n, err := strconv.Atoi(vals[3])
+		if err != nil || n < 1 {
+			return res, errors.New("invalid limit")
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+
+	changes, gen, complete := a.Peers.Changes(since)
+	if !complete && partial {
+		// A full view given page by page goes on where the previous page
+		// stopped, even if the removals since then were forgotten, or it
+		// would start over forever.
+		changes, gen = a.Peers.Modified(since)
+	}
+	res.Reset = !valid || !complete
+	fresh := time.Now().Add(-a.Cfg.peerFreshness()).Unix()
+
+	var size, n int
+	res.Cursor = a.formatCursor(gen, false)
+	for i, c := range changes {
+		share := !c.Removed && a.shareable(c.Onion, c.Peer, onion, fresh)
+		// A full view has nothing to remove, and peers the caller could
+		// not have gotten before, or may not get at all, are not removed
+		// either, so they are never disclosed.
+		if !share && (res.Reset || c.Onion == onion || !c.sharedAt(since) ||
+			!a.Access.Permitted(c.Onion, c.Peer.key())) {
+			continue
+		}
+
+		entry := c.Onion
+		if share {
+			entry = shareEntry(c.Onion, c.Peer, true)
+		}
+
+		// Every peer is quoted, and records get their quotes escaped.
+		esize := len(entry) + strings.Count(entry, `"`) + 3
+		if n == limit || (n > 0 && size+esize > a.Cfg.syncMaxBytes()) {
+			res.Cursor = a.formatCursor(changes[i-1].Gen, res.Reset)
+			res.More = true
+			break
+		}
+		size += esize
+		n++
+
+		if share {
+			res.Peers = append(res.Peers, entry)
+		} else {
+			res.Removed = append(res.Removed, entry)
+		}
+	}
+
+	a.rpcInfo(fmt.Sprintf("sending %d changed and %d removed peers to %s",
+		len(res.Peers), len(res.Removed), onion))
+	return res, nil
+}
@@ -0,0 +1,273 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"testing"
+)
+
+func TestSync(t *testing.T) {
+	n := newTestNode(t)
+	n.Cfg.RateLimit = -1
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+
+	var others []string
+	for i := 0; i < 5; i++ {
+		opk, osk, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := NewRecord(osk, testOnion(opk, 666), nil)
+		if err := n.AppendPeers([]string{rec.String()}); err != nil {
+			t.Fatal(err)
+		}
+		if err := n.SetTrust(rec.Onion, TrustValidated); err != nil {
+			t.Fatal(err)
+		}
+		others = append(others, rec.Onion)
+	}
+
+	ret, err := n.Ann().Init(context.Background(), []string{
+		onion, base64.StdEncoding.EncodeToString(pk), "12345:54321"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Ann().Validate(context.Background(), []string{
+		onion, testSign(n, sk, onion, []string{"12345:54321"}, ret)}); err != nil {
+		t.Fatal(err)
+	}
+	revoke := ret[1]
+
+	sync := func(cursor string, limit string) SyncResult {
+		res, err := n.Ann().Sync(context.Background(),
+			[]string{onion, revoke, cursor, limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if _, err := n.Ann().Sync(context.Background(),
+		[]string{onion, "foo", ""}); err == nil {
+		t.Fatal("sync with a wrong revoke key succeeded")
+	}
+	if _, err := n.Ann().Sync(context.Background(),
+		[]string{onion, revoke, "foo"}); err == nil {
+		t.Fatal("sync with an invalid cursor succeeded")
+	}
+
+	// The initial sync is a full view, given page by page.
+	res := sync("", "2")
+	if !res.Reset || !res.More || len(res.Peers) != 2 {
+		t.Fatalf("got %v for first page", res)
+	}
+	seen := map[string]bool{}
+	for {
+		for _, i := range res.Peers {
+			r, err := ParseRecord(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen[r.Onion] = true
+		}
+		if !res.More {
+			break
+		}
+		res = sync(res.Cursor, "2")
+		if res.Reset {
+			t.Fatal("following page was a reset")
+		}
+	}
+	if len(seen) != len(others) || seen[onion] {
+		t.Fatalf("synced %v, expected %v", seen, others)
+	}
+
+	// Nothing changed since.
+	if r := sync(res.Cursor, ""); len(r.Peers) != 0 || len(r.Removed) != 0 || r.More {
+		t.Fatalf("got %v without changes", r)
+	}
+
+	// Removed and demoted peers are reported as removed.
+	n.Peers.Delete(others[0])
+	if err := n.SetTrust(others[1], TrustGossip); err != nil {
+		t.Fatal(err)
+	}
+	r := sync(res.Cursor, "")
+	if len(r.Peers) != 0 || len(r.Removed) != 2 {
+		t.Fatalf("got %v after removals", r)
+	}
+
+	// Peers never shared, or blocked, are not disclosed as removed.
+	gpk, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gossiped := testOnion(gpk, 666)
+	if err := n.AppendPeers([]string{gossiped}); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Access.Block(others[2]); err != nil {
+		t.Fatal(err)
+	}
+	n.Peers.Update(others[2], func(p Peer, ok bool) (Peer, bool) { return p, ok })
+	n.Peers.Update(onion, func(p Peer, ok bool) (Peer, bool) { return p, ok })
+	if r := sync(r.Cursor, ""); len(r.Peers) != 0 || len(r.Removed) != 0 {
+		t.Fatalf("got %v after gossip and blocking", r)
+	}
+	if err := n.Access.Unblock(others[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pages are limited in size as well.
+	n.Cfg.SyncMaxBytes = 1
+	if r := sync("", ""); len(r.Peers) != 1 || !r.More {
+		t.Fatalf("got %v with a page size of 1 byte", r)
+	}
+
+	// Cursors from before a restart get a full view.
+	n.Peers = NewPeerStore()
+	n.Peers.Put(onion, Peer{Pubkey: pk, PeerRevoke: revoke})
+	if r := sync(res.Cursor, ""); !r.Reset {
+		t.Fatal("cursor of another epoch was honored")
+	}
+}
+
+func TestSyncResetPaging(t *testing.T) {
+	n := newTestNode(t)
+	n.Cfg.RateLimit = -1
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+
+	others := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		opk, osk, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := NewRecord(osk, testOnion(opk, 666), nil)
+		if err := n.AppendPeers([]string{rec.String()}); err != nil {
+			t.Fatal(err)
+		}
+		if err := n.SetTrust(rec.Onion, TrustValidated); err != nil {
+			t.Fatal(err)
+		}
+		others[rec.Onion] = true
+	}
+
+	ret, err := n.Ann().Init(context.Background(), []string{
+		onion, base64.StdEncoding.EncodeToString(pk), "12345:54321"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Ann().Validate(context.Background(), []string{
+		onion, testSign(n, sk, onion, []string{"12345:54321"}, ret)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Forget enough removals for every peer to be older than the floor.
+	for i := 0; i <= maxTombstones; i++ {
+		n.Peers.Put(fmt.Sprint(i), Peer{})
+		n.Peers.Delete(fmt.Sprint(i))
+	}
+
+	var res SyncResult
+	seen := map[string]bool{}
+	for i := 0; i == 0 || res.More; i++ {
+		if i > len(others) {
+			t.Fatal("full view never ends")
+		}
+		res, err = n.Ann().Sync(context.Background(),
+			[]string{onion, ret[1], res.Cursor, "2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Reset {
+			t.Fatalf("page %d of a full view is not a reset", i)
+		}
+		for _, i := range res.Peers {
+			r, err := ParseRecord(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen[r.Onion] = true
+		}
+	}
+	if len(seen) != len(others) {
+		t.Fatalf("synced %v, expected %v", seen, others)
+	}
+
+	// The full view ends with a cursor for the following changes.
+	res, err = n.Ann().Sync(context.Background(),
+		[]string{onion, ret[1], res.Cursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Reset || len(res.Peers) != 0 {
+		t.Fatalf("got %v after the full view", res)
+	}
+}
+
+func TestSyncPeers(t *testing.T) {
+	srv := newTestNode(t)
+	n := newTestNode(t)
+	n.Cfg.TorAddr = startTestServer(t, srv)
+
+	if err := n.SyncPeers(context.Background(), srv.Onion); err == nil {
+		t.Fatal("synced without announcing first")
+	}
+	if err := n.Announce(context.Background(), srv.Onion); err != nil {
+		t.Fatal(err)
+	}
+
+	// Peers the server learns about later are picked up by the sync.
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := NewRecord(sk, testOnion(pk, 666), nil)
+	if err := srv.AppendPeers([]string{rec.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SetTrust(rec.Onion, TrustValidated); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := n.SyncPeers(context.Background(), srv.Onion); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(srv.Onion); p.SyncCursor == "" {
+		t.Fatal("sync cursor was not stored")
+	}
+	if p, ok := n.Peers.Get(rec.Onion); !ok || p.Record == nil {
+		t.Fatal("synced peer was not stored")
+	}
+}
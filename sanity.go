@@ -18,28 +18,87 @@
 package tordam
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"encoding/base32"
 	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+
+	"golang.org/x/crypto/sha3"
 )
 
+// onionVersion is the version byte of Tor v3 Hidden Service addresses.
+const onionVersion = 0x03
+
+// onionChecksum returns the two byte checksum of a Tor v3 Hidden Service
+// address, as defined in rend-spec-v3:
+//  CHECKSUM = H(".onion checksum" | PUBKEY | VERSION)[:2]
+func onionChecksum(pk ed25519.PublicKey) []byte {
+	h := sha3.New256()
+	h.Write([]byte(".onion checksum"))
+	h.Write(pk)
+	h.Write([]byte{onionVersion})
+	return h.Sum(nil)[:2]
+}
+
 // ValidateOnionAddress checks if the given string is a valid Tor v3 Hidden
-// service address. Returns error if not.
+// service address, including its version byte and checksum. Returns error
+// if not.
 func ValidateOnionAddress(addr string) error {
 	aupp := strings.ToUpper(strings.TrimSuffix(addr, ".onion"))
 	if len(aupp) != 56 {
 		return fmt.Errorf("invalid v3 onion address (len != 56)")
 	}
 
-	if _, err := base32.StdEncoding.DecodeString(aupp); err != nil {
+	dec, err := base32.StdEncoding.DecodeString(aupp)
+	if err != nil {
 		return fmt.Errorf("invalid v3 onion address: %s", err)
 	}
 
+	// onion_address = base32(PUBKEY | CHECKSUM | VERSION)
+	pk := ed25519.PublicKey(dec[:ed25519.PublicKeySize])
+	if dec[34] != onionVersion {
+		return fmt.Errorf("invalid v3 onion address (version %d != 3)", dec[34])
+	}
+	if !bytes.Equal(dec[32:34], onionChecksum(pk)) {
+		return fmt.Errorf("invalid v3 onion address (checksum mismatch)")
+	}
+
 	return nil
 }
 
+// OnionAddress returns the Tor v3 Hidden Service address (without a port)
+// belonging to the given ed25519 public key.
+func OnionAddress(pk ed25519.PublicKey) string {
+	raw := make([]byte, 0, 35)
+	raw = append(raw, pk...)
+	raw = append(raw, onionChecksum(pk)...)
+	raw = append(raw, onionVersion)
+	return strings.ToLower(base32.StdEncoding.EncodeToString(raw)) + ".onion"
+}
+
+// OnionPubkey returns the ed25519 public key embedded in the given Tor v3
+// Hidden Service address. The address may optionally carry a port, as in
+// someunlikelyname.onion:port.
+func OnionPubkey(addr string) (ed25519.PublicKey, error) {
+	if i := strings.LastIndex(addr, ":"); i >= 0 {
+		addr = addr[:i]
+	}
+	if err := ValidateOnionAddress(addr); err != nil {
+		return nil, err
+	}
+
+	aupp := strings.ToUpper(strings.TrimSuffix(addr, ".onion"))
+	dec, err := base32.StdEncoding.DecodeString(aupp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v3 onion address: %s", err)
+	}
+
+	return ed25519.PublicKey(dec[:ed25519.PublicKeySize]), nil
+}
+
 // ValidateOnionInternal takes someunlikelyname.onion:port as a parameter
 // and validates its format.
 func ValidateOnionInternal(onionaddr string) error {
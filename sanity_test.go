@@ -17,25 +17,56 @@
 
 package tordam
 
-import "testing"
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
 
 func TestValidateOnionAddress(t *testing.T) {
 	const val0 = "p7qaewjgnvnaeihhyybmoofd5avh665kr3awoxlh5rt6ox743kjdr6qd.onion"
+	const val1 = "duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion"
+	const val2 = "2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wid.onion"
 	const inv0 = "p7qaewjg1vnaeihhyybmoofd5avh665kr3awoxlh5rt6ox743kjdr6qd.onion"
 	const inv1 = "p7qaewjgvybmoofd5avh665kr3awoxlh5rt6ox743kjdr6qd.onion"
 	const inv2 = "p7qaewjgvybmoofd5avh665kr3awoxl1jdr6qd.onion"
+	// Checksum mismatch (first character changed)
+	const inv3 = "euckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion"
+	// Valid checksum, but version 4
+	const inv4 = "hnvcppgow2sc2yvdvdicu3ynonsteflxdxrehjr2ybekdc2z3iu6yzye.onion"
 
-	if err := ValidateOnionAddress(val0); err != nil {
-		t.Fatalf("valid onion address reported invalid: %s", val0)
+	for _, i := range []string{val0, val1, val2} {
+		if err := ValidateOnionAddress(i); err != nil {
+			t.Fatalf("valid onion address reported invalid: %s (%v)", i, err)
+		}
 	}
 
-	for _, i := range []string{inv0, inv1, inv2} {
+	for _, i := range []string{inv0, inv1, inv2, inv3, inv4} {
 		if err := ValidateOnionAddress(i); err == nil {
 			t.Fatalf("invalid onion address reported valid: %s", i)
 		}
 	}
 }
 
+func TestOnionAddress(t *testing.T) {
+	// Key derived from an all-zero seed
+	const addr = "hnvcppgow2sc2yvdvdicu3ynonsteflxdxrehjr2ybekdc2z3iu63yid.onion"
+	pk := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public()
+
+	if a := OnionAddress(pk.(ed25519.PublicKey)); a != addr {
+		t.Fatalf("got onion address %s, expected %s", a, addr)
+	}
+
+	opk, err := OnionPubkey(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opk.Equal(pk) {
+		t.Fatalf("extracted wrong public key from %s", addr)
+	}
+}
+
 func TestValidatePortmap(t *testing.T) {
 	val0 := []string{"1234:3215"}
 	val1 := []string{}
@@ -55,3 +86,25 @@ func TestValidatePortmap(t *testing.T) {
 		}
 	}
 }
+
+func TestOnionPubkey(t *testing.T) {
+	pk, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range []string{testOnion(pk, 666),
+		strings.TrimSuffix(testOnion(pk, 666), ":666")} {
+		opk, err := OnionPubkey(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !opk.Equal(pk) {
+			t.Fatalf("extracted wrong public key from %s", i)
+		}
+	}
+
+	if _, err := OnionPubkey("p7qaewjgvybmoofd5avh665kr3awoxl1jdr6qd.onion"); err == nil {
+		t.Fatal("extracted public key from invalid onion address")
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Seed is an initial peer to announce to. If Pubkey is set, the seed is
+// pinned to it, and Announce refuses to trust it unless it proves to hold
+// that key.
+type Seed struct {
+	Onion  string            // onionaddress:port of the seed
+	Pubkey ed25519.PublicKey // Expected ed25519 public key, or nil
+}
+
+// ParseSeed parses a seed in the form of "unlikelyname.onion:port", or
+// "unlikelyname.onion:port@pubkey" with pubkey being the seed's ed25519
+// public key in base64.
+func ParseSeed(s string) (Seed, error) {
+	var seed Seed
+	var pubkey string
+
+	i := strings.Index(s, "@")
+	if i >= 0 {
+		s, pubkey = s[:i], s[i+1:]
+	}
+
+	if err := ValidateOnionInternal(s); err != nil {
+		return seed, err
+	}
+	seed.Onion = s
+
+	if i >= 0 {
+		pk, err := base64.StdEncoding.DecodeString(pubkey)
+		if err != nil {
+			return seed, fmt.Errorf("invalid base64 seed pubkey (%v)", err)
+		}
+		if len(pk) != ed25519.PublicKeySize {
+			return seed, fmt.Errorf("invalid seed pubkey (len != 32)")
+		}
+		seed.Pubkey = pk
+	}
+
+	return seed, nil
+}
+
+// String returns the seed in the form accepted by ParseSeed.
+func (s Seed) String() string {
+	if s.Pubkey == nil {
+		return s.Onion
+	}
+	return s.Onion + "@" + base64.StdEncoding.EncodeToString(s.Pubkey)
+}
+
+// LoadSeeds reads seeds from the given file, one per line in the form
+// accepted by ParseSeed. Empty lines and lines starting with '#' are
+// ignored. A nonexistent file holds no seeds.
+func LoadSeeds(file string) ([]Seed, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var seeds []Seed
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		seed, err := ParseSeed(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		seeds = append(seeds, seed)
+	}
+
+	return seeds, scanner.Err()
+}
+
+// PinSeeds adds the public keys of the given pinned seeds to Cfg.Pins.
+func (n *Node) PinSeeds(seeds []Seed) {
+	for _, s := range seeds {
+		if s.Pubkey == nil {
+			continue
+		}
+		if n.Cfg.Pins == nil {
+			n.Cfg.Pins = make(map[string]ed25519.PublicKey)
+		}
+		n.Cfg.Pins[s.Onion] = s.Pubkey
+	}
+}
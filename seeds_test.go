@@ -0,0 +1,103 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSeed(t *testing.T) {
+	pk, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 49371)
+	b64pk := base64.StdEncoding.EncodeToString(pk)
+
+	seed, err := ParseSeed(onion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seed.Onion != onion || seed.Pubkey != nil {
+		t.Fatalf("unpinned seed parsed wrong: %v", seed)
+	}
+
+	seed, err = ParseSeed(onion + "@" + b64pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seed.Onion != onion || !seed.Pubkey.Equal(pk) {
+		t.Fatalf("pinned seed parsed wrong: %v", seed)
+	}
+	if seed.String() != onion+"@"+b64pk {
+		t.Fatalf("seed did not round trip: %s", seed)
+	}
+
+	for _, i := range []string{
+		onion + "@",
+		onion + "@foo",
+		onion + "@" + base64.StdEncoding.EncodeToString(pk[:16]),
+		"foo.onion:1@" + b64pk,
+	} {
+		if _, err := ParseSeed(i); err == nil {
+			t.Fatalf("invalid seed parsed: %s", i)
+		}
+	}
+}
+
+func TestLoadSeeds(t *testing.T) {
+	pk, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "tordam-seeds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "seeds")
+
+	data := "# seeds\n\n" + testOnion(pk, 1) + "\n" + testOnion(pk, 2) + "@" +
+		base64.StdEncoding.EncodeToString(pk) + "\n"
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	seeds, err := LoadSeeds(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seeds) != 2 {
+		t.Fatalf("loaded %d seeds, expected 2", len(seeds))
+	}
+
+	n := newTestNode(t)
+	n.PinSeeds(seeds)
+	if _, ok := n.Cfg.Pins[testOnion(pk, 1)]; ok {
+		t.Fatal("unpinned seed was pinned")
+	}
+	if !n.Cfg.Pins[testOnion(pk, 2)].Equal(pk) {
+		t.Fatal("pinned seed was not pinned")
+	}
+}
@@ -0,0 +1,331 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/channel"
+	"github.com/creachadair/jrpc2/handler"
+)
+
+// shutdownPoll is how often Shutdown checks whether the in-flight requests
+// have finished.
+const shutdownPoll = 10 * time.Millisecond
+
+// Server is a JSON-RPC server serving the "ann" endpoint of a Node, along
+// with any services added by the program embedding tordam.
+type Server struct {
+	node     *Node              // Node whose ann endpoint is served
+	services handler.ServiceMap // All served services, "ann" included
+	listener net.Listener       // Listener bound by NewServer
+
+	mu      sync.Mutex                    // Guards the fields below
+	conns   map[*jrpc2.Server]*serverConn // Connections being served
+	active  int                           // Requests not answered yet
+	closing bool                          // Set once Shutdown was called
+}
+
+// serverConn is a connection being served, keeping track of the requests
+// whose response was not sent yet.
+type serverConn struct {
+	channel.Channel
+	s       *Server
+	pending map[string]bool // IDs of the unanswered requests, guarded by s.mu
+}
+
+// NewServer returns a Server for the ann endpoint of the given node, and
+// for the given extra services, which must not be named "ann". The server
+// is bound to the node's Cfg.Listen, but only accepts connections once
+// Serve is called.
+func NewServer(n *Node, services handler.ServiceMap) (*Server, error) {
+	if n.Cfg.Listen == nil {
+		return nil, errors.New("no listen address configured")
+	}
+	if _, ok := services["ann"]; ok {
+		return nil, errors.New("service ann is reserved for tordam")
+	}
+
+	a := n.Ann()
+	s := &Server{
+		node: n,
+		services: handler.ServiceMap{
+			// "ann" is the JSON-RPC endpoint for peer discovery/announcement
+			"ann": handler.Map{
+				"Init":     handler.New(a.Init),
+				"Validate": handler.New(a.Validate),
+				"Recover":  handler.New(a.Recover),
+				"Reclaim":  handler.New(a.Reclaim),
+				"Sync":     handler.New(a.Sync),
+				"Leave":    handler.New(a.Leave),
+				"Rotate":   handler.New(a.Rotate),
+			},
+		},
+		conns: make(map[*jrpc2.Server]*serverConn),
+	}
+	for name, svc := range services {
+		s.services[name] = svc
+	}
+
+	var err error
+	s.listener, err = net.Listen(jrpc2.Network(n.Cfg.Listen.String()))
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve accepts connections and serves their requests, until ctx is done
+// or Shutdown is called. When ctx is done, the connections are closed and
+// the requests still in flight are cancelled. Serve returns once all the
+// connections are closed, with nil if the server was stopped by ctx or by
+// Shutdown, or the error which made it stop accepting connections.
+func (s *Server) Serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		s.listener.Close()
+	}()
+
+	var wg sync.WaitGroup
+	var err error
+	for {
+		var conn net.Conn
+		conn, err = s.listener.Accept()
+		if err != nil {
+			break
+		}
+
+		srv := s.start(conn)
+		if srv == nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.Wait()
+			s.untrack(srv)
+		}()
+	}
+
+	s.mu.Lock()
+	closing := s.closing
+	s.mu.Unlock()
+	if closing || ctx.Err() != nil {
+		err = nil
+	} else {
+		s.node.rpcInternalErr(err.Error())
+		s.stopConns()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// Shutdown may still be draining, but we were told to stop now.
+		s.stopConns()
+		<-done
+	}
+	return err
+}
+
+// Shutdown stops the server from accepting connections and requests, and
+// waits for the requests in flight to be answered before closing the
+// connections. If ctx is done first, the remaining requests are cancelled
+// and the error of ctx is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+	s.listener.Close()
+
+	t := time.NewTicker(shutdownPoll)
+	defer t.Stop()
+	for {
+		s.mu.Lock()
+		active := s.active
+		s.mu.Unlock()
+		if active == 0 {
+			s.stopConns()
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			s.stopConns()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// start starts serving a new connection, unless the server is shutting
+// down, in which case the connection is closed and nil is returned.
+func (s *Server) start(conn net.Conn) *jrpc2.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		conn.Close()
+		return nil
+	}
+
+	c := &serverConn{
+		Channel: channel.RawJSON(conn, conn),
+		s:       s,
+		pending: make(map[string]bool),
+	}
+	srv := jrpc2.NewServer(trackedAssigner{s}, nil)
+	s.conns[srv] = c
+	return srv.Start(c)
+}
+
+// untrack removes a closed connection from the ones being served,
+// forgetting about the requests it will never answer.
+func (s *Server) untrack(srv *jrpc2.Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active -= len(s.conns[srv].pending)
+	delete(s.conns, srv)
+}
+
+// stopConns closes all the connections, cancelling their requests.
+func (s *Server) stopConns() {
+	s.mu.Lock()
+	conns := make([]*jrpc2.Server, 0, len(s.conns))
+	for srv := range s.conns {
+		conns = append(conns, srv)
+	}
+	s.mu.Unlock()
+
+	for _, srv := range conns {
+		srv.Stop()
+	}
+}
+
+// begin registers a request as in flight, unless the server is shutting
+// down. Requests with an ID stay in flight until their response is sent,
+// notifications until end is called.
+func (s *Server) begin(ctx context.Context, req *jrpc2.Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	if !req.IsNotification() {
+		c, ok := s.conns[jrpc2.ServerFromContext(ctx)]
+		if !ok {
+			return false
+		}
+		c.pending[idKey([]byte(req.ID()))] = true
+	}
+	s.active++
+	return true
+}
+
+// end unregisters a notification registered by begin.
+func (s *Server) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+}
+
+// response is the part of a JSON-RPC response serverConn looks at.
+type response struct {
+	ID json.RawMessage `json:"id"`
+}
+
+// Send implements the channel.Channel interface, unregistering the
+// requests answered by msg once it is sent.
+func (c *serverConn) Send(msg []byte) error {
+	err := c.Channel.Send(msg)
+
+	var rsps []response
+	if msg = bytes.TrimSpace(msg); len(msg) > 0 && msg[0] == '[' {
+		json.Unmarshal(msg, &rsps)
+	} else {
+		var rsp response
+		json.Unmarshal(msg, &rsp)
+		rsps = append(rsps, rsp)
+	}
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	for _, i := range rsps {
+		if key := idKey(i.ID); c.pending[key] {
+			delete(c.pending, key)
+			c.s.active--
+		}
+	}
+	return err
+}
+
+// idKey returns the canonical encoding of a request ID, so IDs read from
+// requests and responses can be compared.
+func idKey(id []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(id, &v); err != nil {
+		return string(id)
+	}
+	key, _ := json.Marshal(v)
+	return string(key)
+}
+
+// trackedAssigner assigns the handlers of the served services, keeping
+// track of the requests in flight for Shutdown.
+type trackedAssigner struct {
+	s *Server
+}
+
+// Assign implements the jrpc2.Assigner interface.
+func (t trackedAssigner) Assign(ctx context.Context, method string) jrpc2.Handler {
+	h := t.s.services.Assign(ctx, method)
+	if h == nil {
+		return nil
+	}
+	return handler.Func(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+		if !t.s.begin(ctx, req) {
+			return nil, errors.New("server is shutting down")
+		}
+		if req.IsNotification() {
+			defer t.s.end()
+		}
+		return h.Handle(ctx, req)
+	})
+}
+
+// Names implements the jrpc2.Namer interface.
+func (t trackedAssigner) Names() []string {
+	return t.s.services.Names()
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/channel"
+	"github.com/creachadair/jrpc2/handler"
+)
+
+// startBlockServer starts a Server for the given node with an extra "test"
+// service. Its Echo method returns its parameter, and its Block method
+// signals started and waits for release or for its request to be
+// cancelled. It returns the server, and the channel Serve returns on.
+func startBlockServer(t *testing.T, n *Node, started, release chan struct{}) (*Server, chan error) {
+	n.Cfg.Listen = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	srv, err := NewServer(n, handler.ServiceMap{
+		"test": handler.Map{
+			"Echo": handler.New(func(ctx context.Context, vals []string) ([]string, error) {
+				return vals, nil
+			}),
+			"Block": handler.New(func(ctx context.Context) (string, error) {
+				close(started)
+				select {
+				case <-release:
+					return "released", nil
+				case <-ctx.Done():
+					return "", ctx.Err()
+				}
+			}),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(context.Background()) }()
+	return srv, done
+}
+
+// dialTestServer returns a channel connected to the given server.
+func dialTestServer(t *testing.T, srv *Server) channel.Channel {
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := channel.RawJSON(conn, conn)
+	t.Cleanup(func() { ch.Close() })
+	return ch
+}
+
+func TestServer(t *testing.T) {
+	n := newTestNode(t)
+
+	if _, err := NewServer(n, nil); err == nil {
+		t.Fatal("server created without a listen address")
+	}
+	n.Cfg.Listen = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	if _, err := NewServer(n, handler.ServiceMap{"ann": handler.Map{}}); err == nil {
+		t.Fatal("ann service was replaced")
+	}
+
+	srv, done := startBlockServer(t, n, make(chan struct{}), nil)
+	cli := jrpc2.NewClient(dialTestServer(t, srv), nil)
+
+	// Our services and the ann endpoint are served together.
+	var echo []string
+	if err := cli.CallResult(context.Background(), "test.Echo",
+		[]string{"foo"}, &echo); err != nil || len(echo) != 1 || echo[0] != "foo" {
+		t.Fatalf("got %v, %v from test.Echo", echo, err)
+	}
+	var ret []string
+	if err := cli.CallResult(context.Background(), "ann.Init", []string{
+		n.Onion, base64.StdEncoding.EncodeToString(testKey(n)),
+		"12345:54321"}, &ret); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.Dial("tcp", srv.Addr().String()); err == nil {
+		t.Fatal("server accepted a connection after shutdown")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	n := newTestNode(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	srv, done := startBlockServer(t, n, started, release)
+
+	// The jrpc2 client may drop a response arriving right before the
+	// connection is closed, so the wire is read directly.
+	ch := dialTestServer(t, srv)
+	if err := ch.Send([]byte(`{"jsonrpc":"2.0","id":1,"method":"test.Block"}`)); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	shut := make(chan error, 1)
+	go func() { shut <- srv.Shutdown(context.Background()) }()
+
+	// The request in flight is waited for, but new ones are refused.
+	select {
+	case err := <-shut:
+		t.Fatalf("shutdown returned with a request in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if srv.begin(context.Background(), &jrpc2.Request{}) {
+		t.Fatal("request accepted while shutting down")
+	}
+
+	close(release)
+	rsp, err := ch.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(rsp), `"result":"released"`) {
+		t.Fatalf("drained request returned %s", rsp)
+	}
+	if err := <-shut; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	n := newTestNode(t)
+	started := make(chan struct{})
+	srv, done := startBlockServer(t, n, started, make(chan struct{}))
+	cli := jrpc2.NewClient(dialTestServer(t, srv), nil)
+
+	called := make(chan error, 1)
+	go func() {
+		_, err := cli.Call(context.Background(), "test.Block", nil)
+		called <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v from shutdown, expected a deadline error", err)
+	}
+	if err := <-called; err == nil {
+		t.Fatal("request survived the shutdown deadline")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerCancel(t *testing.T) {
+	n := newTestNode(t)
+	n.Cfg.Listen = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	srv, err := NewServer(n, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ctx) }()
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after its context was cancelled")
+	}
+}
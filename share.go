@@ -0,0 +1,172 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SharePolicy selects which of the peers eligible for sharing are handed
+// out to a peer in ann.Validate. Limiting what is disclosed to every caller
+// makes it harder to map the network, or to eclipse a peer by learning all
+// of its neighbours.
+type SharePolicy interface {
+	// Select returns the onion addresses to share, out of the given
+	// candidates.
+	Select(candidates map[string]Peer) []string
+}
+
+// ShareAll shares every eligible peer. It is the default policy.
+type ShareAll struct{}
+
+// Select implements SharePolicy.
+func (ShareAll) Select(candidates map[string]Peer) []string {
+	ret := make([]string, 0, len(candidates))
+	for onion := range candidates {
+		ret = append(ret, onion)
+	}
+	return ret
+}
+
+// ShareNone shares no peers at all.
+type ShareNone struct{}
+
+// Select implements SharePolicy.
+func (ShareNone) Select(map[string]Peer) []string {
+	return nil
+}
+
+// ShareRandom shares a uniformly random sample of N eligible peers.
+type ShareRandom struct {
+	N int // Number of peers to share
+}
+
+// Select implements SharePolicy.
+func (s ShareRandom) Select(candidates map[string]Peer) []string {
+	ret := ShareAll{}.Select(candidates)
+	rnd := newRand()
+	rnd.Shuffle(len(ret), func(i, j int) { ret[i], ret[j] = ret[j], ret[i] })
+	return truncate(ret, s.N)
+}
+
+// ShareFreshest shares the N most recently seen eligible peers.
+type ShareFreshest struct {
+	N int // Number of peers to share
+}
+
+// Select implements SharePolicy.
+func (s ShareFreshest) Select(candidates map[string]Peer) []string {
+	ret := ShareAll{}.Select(candidates)
+	sort.Slice(ret, func(i, j int) bool {
+		return candidates[ret[i]].LastSeen > candidates[ret[j]].LastSeen
+	})
+	return truncate(ret, s.N)
+}
+
+// ShareTrustWeighted shares a random sample of N eligible peers, in which
+// peers are picked with a probability proportional to their trust level.
+type ShareTrustWeighted struct {
+	N int // Number of peers to share
+}
+
+// Select implements SharePolicy.
+func (s ShareTrustWeighted) Select(candidates map[string]Peer) []string {
+	// Weighted sampling without replacement: every peer gets the key
+	// u^(1/weight) for a uniform random u, and the highest keys win.
+	rnd := newRand()
+	keys := make(map[string]float64, len(candidates))
+	ret := make([]string, 0, len(candidates))
+	for onion, peer := range candidates {
+		w := float64(peer.Trusted)
+		if w < 1 {
+			w = 1
+		}
+		keys[onion] = math.Pow(rnd.Float64(), 1/w)
+		ret = append(ret, onion)
+	}
+	sort.Slice(ret, func(i, j int) bool { return keys[ret[i]] > keys[ret[j]] })
+	return truncate(ret, s.N)
+}
+
+// ParseSharePolicy parses a SharePolicy from its textual form, being one
+// of "all", "none", "random:N", "freshest:N" or "trust:N".
+func ParseSharePolicy(s string) (SharePolicy, error) {
+	switch s {
+	case "all":
+		return ShareAll{}, nil
+	case "none":
+		return ShareNone{}, nil
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid share policy: %s", s)
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid share policy count: %s", parts[1])
+	}
+
+	switch parts[0] {
+	case "random":
+		return ShareRandom{N: n}, nil
+	case "freshest":
+		return ShareFreshest{N: n}, nil
+	case "trust":
+		return ShareTrustWeighted{N: n}, nil
+	}
+	return nil, fmt.Errorf("invalid share policy: %s", s)
+}
+
+// sharePolicy returns the SharePolicy for a caller with the given trust
+// level.
+func (c Config) sharePolicy(trust int) SharePolicy {
+	if p, ok := c.SharePolicies[trust]; ok && p != nil {
+		return p
+	}
+	if c.SharePolicy != nil {
+		return c.SharePolicy
+	}
+	return ShareAll{}
+}
+
+// truncate returns at most the first n elements of s.
+func truncate(s []string, n int) []string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// newRand returns a math/rand source seeded from crypto/rand, so callers
+// can't predict which peers get sampled.
+func newRand() *rand.Rand {
+	var seed [8]byte
+	if _, err := crand.Read(seed[:]); err != nil {
+		return rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(seed[:]))))
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestSharePolicy(t *testing.T) {
+	now := time.Now().Unix()
+	candidates := map[string]Peer{}
+	for i := 0; i < 10; i++ {
+		pk, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		candidates[testOnion(pk, 666)] = Peer{
+			LastSeen: now - int64(i),
+			Trusted:  TrustValidated,
+		}
+	}
+
+	if n := len(ShareAll{}.Select(candidates)); n != 10 {
+		t.Fatalf("ShareAll shared %d peers, expected 10", n)
+	}
+	if n := len(ShareNone{}.Select(candidates)); n != 0 {
+		t.Fatalf("ShareNone shared %d peers", n)
+	}
+	if n := len(ShareRandom{N: 3}.Select(candidates)); n != 3 {
+		t.Fatalf("ShareRandom shared %d peers, expected 3", n)
+	}
+	if n := len(ShareRandom{N: 20}.Select(candidates)); n != 10 {
+		t.Fatalf("ShareRandom shared %d peers, expected 10", n)
+	}
+
+	fresh := ShareFreshest{N: 3}.Select(candidates)
+	if len(fresh) != 3 {
+		t.Fatalf("ShareFreshest shared %d peers, expected 3", len(fresh))
+	}
+	for _, i := range fresh {
+		if candidates[i].LastSeen < now-2 {
+			t.Fatalf("ShareFreshest shared %s, seen at %d", i, candidates[i].LastSeen)
+		}
+	}
+
+	// A pinned peer among peers of the lowest trust should nearly always
+	// make it into a sample of one.
+	var pinned string
+	for onion, peer := range candidates {
+		if pinned == "" {
+			pinned = onion
+			peer.Trusted = TrustPinned
+		} else {
+			peer.Trusted = TrustGossip
+		}
+		candidates[onion] = peer
+	}
+	var hits int
+	for i := 0; i < 1000; i++ {
+		if (ShareTrustWeighted{N: 1}).Select(candidates)[0] == pinned {
+			hits++
+		}
+	}
+	if hits < 200 {
+		t.Fatalf("pinned peer was picked %d times out of 1000", hits)
+	}
+
+	for _, s := range []string{"all", "none", "random:5", "freshest:5", "trust:5"} {
+		if _, err := ParseSharePolicy(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range []string{"", "some", "random", "random:0", "fresh:5"} {
+		if _, err := ParseSharePolicy(s); err == nil {
+			t.Fatalf("invalid share policy %q was parsed", s)
+		}
+	}
+}
+
+func TestValidateSharePolicy(t *testing.T) {
+	n := newTestNode(t)
+
+	for i := 0; i < 10; i++ {
+		pk, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.SetTrust(testOnion(pk, 666), TrustValidated); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := testOnion(pk, 666)
+
+	var revoke string
+	validate := func() []string {
+		ret, err := n.Ann().Init(context.Background(), []string{onion,
+			base64.StdEncoding.EncodeToString(pk), "12345:54321", revoke})
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers, err := n.Ann().Validate(context.Background(), []string{
+			onion, testSign(n, sk, onion, []string{"12345:54321"}, ret)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		revoke = ret[1]
+		return peers
+	}
+
+	if c := len(validate()); c != 10 {
+		t.Fatalf("got %d peers by default, expected 10", c)
+	}
+
+	n.Cfg.SharePolicy = ShareRandom{N: 4}
+	if c := len(validate()); c != 4 {
+		t.Fatalf("got %d peers with ShareRandom, expected 4", c)
+	}
+	if _, err := n.Ann().Sync(context.Background(),
+		[]string{onion, revoke, ""}); err == nil {
+		t.Fatal("sync permitted without ShareAll")
+	}
+
+	// The caller is validated now, so its trust level's policy applies.
+	n.Cfg.SharePolicies = map[int]SharePolicy{TrustValidated: ShareNone{}}
+	if c := len(validate()); c != 0 {
+		t.Fatalf("got %d peers with ShareNone, expected none", c)
+	}
+}
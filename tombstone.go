@@ -0,0 +1,176 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// leaveTag is the protocol tag and version of the Tombstone encoding.
+const leaveTag = "tordam-leave-v1"
+
+// Tombstone is the statement of a peer leaving the network for good, signed
+// with its own key. Like a PeerRecord, it is relayed between peers, so the
+// departure spreads across the network and can be verified end to end.
+// In peer lists, tombstones are JSON encoded and prefixed with "-".
+type Tombstone struct {
+	Onion     string            `json:"onion"`     // onionaddress:port of the peer
+	Pubkey    ed25519.PublicKey `json:"pubkey"`    // Peer's ed25519 public key
+	Timestamp int64             `json:"timestamp"` // Time the peer left
+	Signature []byte            `json:"signature"` // Signature over Bytes()
+}
+
+// NewTombstone returns a Tombstone for the given onion, signed with the
+// given key.
+func NewTombstone(sk ed25519.PrivateKey, onion string) Tombstone {
+	t := Tombstone{
+		Onion:     onion,
+		Pubkey:    sk.Public().(ed25519.PublicKey),
+		Timestamp: time.Now().Unix(),
+	}
+	t.Signature = ed25519.Sign(sk, t.Bytes())
+	return t
+}
+
+// Bytes returns the canonical encoding of the tombstone, which is what gets
+// signed and verified.
+func (t Tombstone) Bytes() []byte {
+	return []byte(strings.Join([]string{
+		leaveTag,
+		t.Onion,
+		base64.StdEncoding.EncodeToString(t.Pubkey),
+		strconv.FormatInt(t.Timestamp, 10),
+	}, "\n"))
+}
+
+// Verify checks the tombstone is well formed and signed by its own public
+// key.
+func (t Tombstone) Verify() error {
+	if err := ValidateOnionInternal(t.Onion); err != nil {
+		return err
+	}
+	if len(t.Pubkey) != ed25519.PublicKeySize {
+		return errors.New("invalid tombstone public key")
+	}
+	if !ed25519.Verify(t.Pubkey, t.Bytes(), t.Signature) {
+		return fmt.Errorf("invalid tombstone signature for %s", t.Onion)
+	}
+	return nil
+}
+
+// String returns the peer list entry of the tombstone.
+func (t Tombstone) String() string {
+	data, _ := json.Marshal(t)
+	return "-" + string(data)
+}
+
+// ParseTombstone parses and verifies a tombstone peer list entry.
+func ParseTombstone(s string) (Tombstone, error) {
+	var t Tombstone
+	if !isTombstone(s) {
+		return t, errors.New("invalid tombstone")
+	}
+	if len(s) > maxRecordSize {
+		return t, errors.New("tombstone too large")
+	}
+	if err := json.Unmarshal([]byte(s[1:]), &t); err != nil {
+		return t, errors.New("invalid tombstone")
+	}
+	return t, t.Verify()
+}
+
+// parseTombstone parses and verifies a tombstone peer list entry received
+// by the node. Tombstones dated further than maxClockSkew in the future
+// are refused, as they would never be reaped. With Cfg.BindOnionKey, the
+// public key must also be the onion key.
+func (n *Node) parseTombstone(s string) (Tombstone, error) {
+	t, err := ParseTombstone(s)
+	if err != nil {
+		return t, err
+	}
+	if t.Timestamp > time.Now().Add(maxClockSkew).Unix() {
+		return t, fmt.Errorf("tombstone of %s is dated in the future", t.Onion)
+	}
+	if !n.Cfg.BindOnionKey {
+		return t, nil
+	}
+	opk, err := OnionPubkey(t.Onion)
+	if err != nil {
+		return t, err
+	}
+	if !opk.Equal(t.Pubkey) {
+		return t, fmt.Errorf("tombstone of %s holds a foreign key", t.Onion)
+	}
+	return t, nil
+}
+
+// isTombstone reports whether the given peer list entry is a Tombstone.
+func isTombstone(s string) bool {
+	return strings.HasPrefix(s, "-{")
+}
+
+// bury applies the given verified tombstone to the node's Peers store. The
+// peer's key and revoke keys are forgotten, so it can announce anew should
+// it ever come back, and the entry is left to be reaped. Tombstones older
+// than what we know about the peer, or of a key other than the one we know,
+// are ignored. This includes tombstones older than the last handshake with
+// a peer which proved its key, as the peer came back since it left. So are tombstones of peers whose key we don't know, as
+// anyone could sign those, unless Cfg.BindOnionKey proved the key. It
+// reports whether the tombstone was applied.
+func (n *Node) bury(t Tombstone) bool {
+	buried := n.Peers.Update(t.Onion, func(peer Peer, ok bool) (Peer, bool) {
+		key := peer.key()
+		if key == nil && !n.Cfg.BindOnionKey {
+			return peer, false
+		}
+		if key != nil && !key.Equal(t.Pubkey) {
+			return peer, false
+		}
+		if peer.Left != nil && peer.Left.Timestamp >= t.Timestamp {
+			return peer, false
+		}
+		if peer.Record != nil && peer.Record.Timestamp > t.Timestamp {
+			return peer, false
+		}
+		if peer.Pubkey != nil && peer.LastSeen > t.Timestamp {
+			return peer, false
+		}
+
+		return Peer{
+			LastSeen: t.Timestamp,
+			Trusted:  TrustGossip,
+			Left:     &t,
+		}, true
+	})
+	if !buried {
+		return false
+	}
+
+	if err := n.Revokes.Delete(t.Onion); err != nil {
+		n.rpcInternalErr(err.Error())
+	}
+	n.rpcInfo(fmt.Sprintf("%s left the network", t.Onion))
+	return true
+}
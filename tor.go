@@ -18,10 +18,14 @@
 package tordam
 
 import (
+	"crypto/ed25519"
+	"crypto/sha512"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 )
 
@@ -51,15 +55,16 @@ HiddenServicePort %d %s
 // SpawnTor runs the system's Tor binary with the torrc created by newtorrc.
 // It takes listener (which is the local JSON-RPC server net.TCPAddr),
 // portmap (to map HiddenServicePort entries) and datadir (to store Tor files)
-// as parameters. Returns exec.Cmd pointer and/or error.
-func SpawnTor(listener *net.TCPAddr, portmap []string, datadir string) (*exec.Cmd, error) {
+// as parameters. The node's Cfg.TorAddr is pointed at the SOCKS5 proxy of
+// the spawned Tor. Returns exec.Cmd pointer and/or error.
+func (n *Node) SpawnTor(listener *net.TCPAddr, portmap []string, datadir string) (*exec.Cmd, error) {
 	var err error
 
 	if err = ValidatePortmap(portmap); err != nil {
 		return nil, err
 	}
 
-	Cfg.TorAddr, err = GetAvailableListener()
+	n.Cfg.TorAddr, err = GetAvailableListener()
 	if err != nil {
 		return nil, err
 	}
@@ -69,7 +74,44 @@ func SpawnTor(listener *net.TCPAddr, portmap []string, datadir string) (*exec.Cm
 	}
 
 	cmd := exec.Command("tor", "-f", "-")
-	cmd.Stdin = strings.NewReader(newtorrc(listener, Cfg.TorAddr, portmap))
+	cmd.Stdin = strings.NewReader(newtorrc(listener, n.Cfg.TorAddr, portmap))
 	cmd.Dir = datadir
 	return cmd, cmd.Start()
 }
+
+// WriteHSKey writes the given ed25519 private key into hsdir in the format
+// Tor uses for v3 Hidden Service keys, making our signing key and onion
+// address the same identity. This must be done before SpawnTor, and it
+// replaces any key (and thus onion address) Tor generated before. hsdir
+// is the "hs" directory inside the data directory given to SpawnTor.
+func WriteHSKey(hsdir string, sk ed25519.PrivateKey) error {
+	if err := os.MkdirAll(hsdir, 0700); err != nil {
+		return err
+	}
+
+	// Tor stores the expanded secret key rather than the seed.
+	h := sha512.Sum512(sk.Seed())
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+
+	secret := append([]byte("== ed25519v1-secret: type0 ==\x00\x00\x00"), h[:]...)
+	public := append([]byte("== ed25519v1-public: type0 ==\x00\x00\x00"),
+		sk.Public().(ed25519.PublicKey)...)
+
+	if err := ioutil.WriteFile(filepath.Join(hsdir, "hs_ed25519_secret_key"),
+		secret, 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(hsdir, "hs_ed25519_public_key"),
+		public, 0600); err != nil {
+		return err
+	}
+
+	// Tor writes the hostname itself, remove a possibly stale one.
+	if err := os.Remove(filepath.Join(hsdir, "hostname")); err != nil &&
+		!os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
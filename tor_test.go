@@ -18,8 +18,13 @@
 package tordam
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"testing"
 )
 
@@ -31,7 +36,8 @@ func TestSpawnTor(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	tor, err := SpawnTor(l, []string{"1234:1234"}, "tor_test")
+	n := newTestNode(t)
+	tor, err := n.SpawnTor(l, []string{"1234:1234"}, "tor_test")
 	defer func() {
 		if err := tor.Process.Kill(); err != nil {
 			t.Fatal(err)
@@ -42,3 +48,35 @@ func TestSpawnTor(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestWriteHSKey(t *testing.T) {
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "tordam-hs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := WriteHSKey(dir, sk); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := ioutil.ReadFile(filepath.Join(dir, "hs_ed25519_secret_key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 96 {
+		t.Fatalf("secret key file has length %d, expected 96", len(secret))
+	}
+
+	public, err := ioutil.ReadFile(filepath.Join(dir, "hs_ed25519_public_key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(public) != 64 || !bytes.Equal(public[32:], pk) {
+		t.Fatal("public key file does not contain our public key")
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"fmt"
+	"time"
+)
+
+// Trust levels of a peer, as found in Peer.Trusted. Higher levels imply
+// more trust.
+//
+// Peers are promoted automatically: to TrustGossip whenever another peer
+// tells us about them, to TrustValidated when they complete an announce to
+// us or prove their identity when we announce to them, and to TrustPinned
+// when they prove, as we announce to them, to hold the key pinned for them
+// in Cfg.Pins. Promotions never lower a peer's level. TrustVouched is only
+// ever set by the operator, through SetTrust, which can also set any other
+// level. Peers are demoted automatically in two cases: ReapPeers takes
+// stale TrustValidated peers back to TrustGossip, and a peer leaving the
+// network with a Tombstone is reset to TrustGossip.
+const (
+	TrustUnknown   = iota // Nothing is known about the peer
+	TrustGossip           // Learned about from another peer
+	TrustValidated        // Proved its identity to us
+	TrustVouched          // Vouched for by the operator
+	TrustPinned           // Proved to hold its pinned public key
+)
+
+// promote returns the higher of the two given trust levels.
+func promote(cur, level int) int {
+	if level > cur {
+		return level
+	}
+	return cur
+}
+
+// SetTrust manually sets the trust level of the given peer, adding it to
+// the node's Peers store if it isn't known yet.
+func (n *Node) SetTrust(onion string, level int) error {
+	if level < TrustUnknown || level > TrustPinned {
+		return fmt.Errorf("invalid trust level %d", level)
+	}
+	if err := ValidateOnionInternal(onion); err != nil {
+		return err
+	}
+
+	n.Peers.Update(onion, func(peer Peer, ok bool) (Peer, bool) {
+		if !ok {
+			peer.LastSeen = time.Now().Unix()
+		}
+		peer.Trusted = level
+		return peer, true
+	})
+	return nil
+}
+
+// PeersWithTrust returns a copy of all peers in the node's Peers store with
+// at least the given trust level.
+func (n *Node) PeersWithTrust(min int) map[string]Peer {
+	ret := make(map[string]Peer)
+	n.Peers.Range(func(onion string, peer Peer) bool {
+		if peer.Trusted >= min {
+			ret[onion] = peer
+		}
+		return true
+	})
+	return ret
+}
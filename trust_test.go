@@ -0,0 +1,88 @@
+// Copyright (c) 2017-2021 Ivan Jelincic <parazyd@dyne.org>
+//
+// This file is part of tordam
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package tordam
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+)
+
+func TestTrust(t *testing.T) {
+	n := newTestNode(t)
+
+	pk, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gossip := testOnion(pk, 1)
+	vouched := testOnion(pk, 2)
+
+	if err := n.AppendPeers([]string{gossip}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(gossip); p.Trusted != TrustGossip {
+		t.Fatalf("gossiped peer has trust %d, expected %d", p.Trusted, TrustGossip)
+	}
+
+	if err := n.SetTrust(vouched, TrustVouched); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.SetTrust(vouched, TrustPinned+1); err == nil {
+		t.Fatal("invalid trust level was accepted")
+	}
+	if err := n.SetTrust("foo.onion:1", TrustVouched); err == nil {
+		t.Fatal("trust of an invalid onion was set")
+	}
+
+	// Gossip must never lower the trust of a known peer.
+	if err := n.AppendPeers([]string{vouched}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(vouched); p.Trusted != TrustVouched {
+		t.Fatal("gossip changed the trust of a known peer")
+	}
+
+	// Gossip does promote known peers of unknown trust, without making
+	// them any fresher.
+	if err := n.SetTrust(gossip, TrustUnknown); err != nil {
+		t.Fatal(err)
+	}
+	n.Peers.Update(gossip, func(p Peer, ok bool) (Peer, bool) {
+		p.LastSeen = 1
+		return p, true
+	})
+	if err := n.AppendPeers([]string{gossip}); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Peers.Get(gossip); p.Trusted != TrustGossip || p.LastSeen != 1 {
+		t.Fatalf("gossip of a known peer gave trust %d and lastseen %d", p.Trusted, p.LastSeen)
+	}
+
+	if c := len(n.PeersWithTrust(TrustGossip)); c != 2 {
+		t.Fatalf("got %d peers trusted at least as gossip, expected 2", c)
+	}
+	peers := n.PeersWithTrust(TrustValidated)
+	if _, ok := peers[vouched]; !ok || len(peers) != 1 {
+		t.Fatalf("got %v for validated peers, expected only %s", peers, vouched)
+	}
+
+	if promote(TrustVouched, TrustValidated) != TrustVouched {
+		t.Fatal("promote lowered the trust level")
+	}
+}